@@ -0,0 +1,164 @@
+package adapters
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/transport"
+)
+
+type AdminHandlerOptions struct {
+	// Decides whether a request may use the admin API. Every request is
+	// refused when it is nil.
+	Authorize func(r *http.Request) bool
+}
+
+// ClientInfo describes a client held by the engine
+type ClientInfo struct {
+	Id         string    `json:"id"`
+	Transport  string    `json:"transport,omitempty"`
+	Created    time.Time `json:"created"`
+	LastSeen   time.Time `json:"lastSeen"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	UserAgent  string    `json:"userAgent,omitempty"`
+	// Subject of the authenticated principal
+	Subject       string   `json:"subject,omitempty"`
+	Subscriptions []string `json:"subscriptions"`
+	// Messages held for a polling client between requests
+	Queued int `json:"queued"`
+	// Messages sent and failed since the last statistics report
+	Sent   uint64 `json:"sent"`
+	Failed uint64 `json:"failed"`
+}
+
+// ChannelInfo describes a subscribed channel pattern
+type ChannelInfo struct {
+	Channel     string `json:"channel"`
+	Subscribers int    `json:"subscribers"`
+}
+
+func clientInfo(client *protocol.Client) ClientInfo {
+	peer := client.Peer()
+	counters := client.Counters()
+	subscriptions := client.Subscriptions()
+	sort.Strings(subscriptions)
+	info := ClientInfo{
+		Id:            fmt.Sprintf("client-%d", client.Id()),
+		Transport:     transportName(client.Connection()),
+		Created:       client.Created(),
+		LastSeen:      client.LastSeen(),
+		RemoteAddr:    peer.RemoteAddr,
+		UserAgent:     peer.UserAgent,
+		Subscriptions: subscriptions,
+		Queued:        client.QueueLength(),
+		Sent:          counters.Sent,
+		Failed:        counters.Failed,
+	}
+	if principal := client.Principal(); principal != nil {
+		info.Subject = principal.Subject
+	}
+	return info
+}
+
+func transportName(conn protocol.Connection) string {
+	switch conn.(type) {
+	case *transport.WebSocketConnection:
+		return "websocket"
+	case *transport.EventSourceConnection:
+		return "eventsource"
+	case *transport.CallbackPollingConnection:
+		return "callback-polling"
+	case *transport.LongPollingConnection:
+		return "long-polling"
+	}
+	return ""
+}
+
+// AdminHandler serves a JSON API to inspect and manage the clients of
+// engine, relative to where it is mounted:
+//
+//	GET    /clients                              clients ordered by id
+//	GET    /clients/{id}                         one client
+//	DELETE /clients/{id}                         disconnect a client
+//	DELETE /clients/{id}/subscriptions/{channel} unsubscribe a client
+//	GET    /channels                             patterns and their subscribers
+//
+// Mount it with http.StripPrefix, e.g. under /admin/.
+func AdminHandler(engine *faye.Engine, options AdminHandlerOptions) http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		clients := engine.Clients()
+		infos := make([]ClientInfo, len(clients))
+		for i, client := range clients {
+			infos[i] = clientInfo(client)
+		}
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	mux.HandleFunc("GET /clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if client := lookupClient(engine, w, r); client != nil {
+			writeJSON(w, http.StatusOK, clientInfo(client))
+		}
+	})
+
+	mux.HandleFunc("DELETE /clients/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if client := lookupClient(engine, w, r); client != nil {
+			engine.RemoveClient(client)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+
+	mux.HandleFunc("DELETE /clients/{id}/subscriptions/{channel...}", func(w http.ResponseWriter, r *http.Request) {
+		client := lookupClient(engine, w, r)
+		if client == nil {
+			return
+		}
+		channel := "/" + r.PathValue("channel")
+		if !client.IsSubscribed(channel) {
+			http.Error(w, "Not subscribed", http.StatusNotFound)
+			return
+		}
+		engine.UnsubscribeFrom(client, []string{channel})
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	mux.HandleFunc("GET /channels", func(w http.ResponseWriter, r *http.Request) {
+		counts := engine.Channels()
+		infos := make([]ChannelInfo, 0, len(counts))
+		for channel, subscribers := range counts {
+			infos = append(infos, ChannelInfo{Channel: channel, Subscribers: subscribers})
+		}
+		sort.Slice(infos, func(i, j int) bool { return infos[i].Channel < infos[j].Channel })
+		writeJSON(w, http.StatusOK, infos)
+	})
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if options.Authorize == nil || !options.Authorize(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// lookupClient returns the client named by the id path value, answering
+// with 404 when there is none
+func lookupClient(engine *faye.Engine, w http.ResponseWriter, r *http.Request) *protocol.Client {
+	client := engine.GetClient(protocol.ParseClientId(r.PathValue("id")))
+	if client == nil {
+		http.Error(w, "Unknown client", http.StatusNotFound)
+	}
+	return client
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
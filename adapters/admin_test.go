@@ -0,0 +1,96 @@
+package adapters
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/protocol"
+)
+
+func TestAdminHandler(t *testing.T) {
+	engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+	t.Cleanup(engine.Close)
+	subscribe := func(client *protocol.Client, subs ...interface{}) {
+		msg := protocol.Message{"channel": "/meta/subscribe", "subscription": subs}
+		engine.SubscribeClient(&msg, client, &publishConnection{})
+	}
+	alice := engine.NewClient(&publishConnection{peer: protocol.PeerInfo{RemoteAddr: "10.0.0.1", UserAgent: "browser"}})
+	alice.SetPrincipal(&protocol.Principal{Subject: "alice"})
+	subscribe(alice, "/chat/**", "/news")
+	bob := engine.NewClient(&publishConnection{})
+	subscribe(bob, "/news")
+
+	handler := AdminHandler(engine, AdminHandlerOptions{
+		Authorize: func(r *http.Request) bool { return r.Header.Get("X-Admin") == "yes" },
+	})
+	ts := httptest.NewServer(http.StripPrefix("/admin", handler))
+	defer ts.Close()
+
+	request := func(method, path string, admin bool, v interface{}) int {
+		req, _ := http.NewRequest(method, ts.URL+"/admin"+path, nil)
+		if admin {
+			req.Header.Set("X-Admin", "yes")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil && resp.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	if status := request("GET", "/clients", false, nil); status != http.StatusForbidden {
+		t.Errorf("unauthorized request = %d, want 403", status)
+	}
+
+	var clients []ClientInfo
+	if status := request("GET", "/clients", true, &clients); status != http.StatusOK {
+		t.Fatalf("list clients = %d", status)
+	}
+	if len(clients) != 2 || clients[0].Id != "client-1" || clients[1].Id != "client-2" {
+		t.Fatalf("clients = %+v", clients)
+	}
+	if got := clients[0]; got.RemoteAddr != "10.0.0.1" || got.UserAgent != "browser" || got.Subject != "alice" ||
+		!reflect.DeepEqual(got.Subscriptions, []string{"/chat/**", "/news"}) || got.Created.IsZero() {
+		t.Errorf("alice = %+v", got)
+	}
+
+	var channels []ChannelInfo
+	request("GET", "/channels", true, &channels)
+	if want := []ChannelInfo{{"/chat/**", 1}, {"/news", 2}}; !reflect.DeepEqual(channels, want) {
+		t.Errorf("channels = %+v, want %+v", channels, want)
+	}
+
+	if status := request("DELETE", "/clients/client-1/subscriptions/chat/**", true, nil); status != http.StatusNoContent {
+		t.Errorf("unsubscribe = %d, want 204", status)
+	}
+	if status := request("DELETE", "/clients/client-1/subscriptions/chat/**", true, nil); status != http.StatusNotFound {
+		t.Errorf("unsubscribe again = %d, want 404", status)
+	}
+	var client ClientInfo
+	request("GET", "/clients/client-1", true, &client)
+	if !reflect.DeepEqual(client.Subscriptions, []string{"/news"}) {
+		t.Errorf("subscriptions after unsubscribe = %v", client.Subscriptions)
+	}
+
+	if status := request("DELETE", "/clients/client-2", true, nil); status != http.StatusNoContent {
+		t.Errorf("disconnect = %d, want 204", status)
+	}
+	if status := request("GET", "/clients/client-2", true, nil); status != http.StatusNotFound {
+		t.Errorf("disconnected client = %d, want 404", status)
+	}
+	request("GET", "/channels", true, &channels)
+	if want := []ChannelInfo{{"/news", 1}}; !reflect.DeepEqual(channels, want) {
+		t.Errorf("channels after disconnect = %+v, want %+v", channels, want)
+	}
+}
@@ -0,0 +1,81 @@
+package adapters
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+// browserTracker counts the connect polls held per browser, identified by a
+// cookie, to detect several tabs polling through one browser
+type browserTracker struct {
+	cookie string
+	mutex  sync.Mutex
+	polls  map[string]int
+}
+
+func newBrowserTracker(cookie string) *browserTracker {
+	return &browserTracker{cookie: cookie, polls: make(map[string]int)}
+}
+
+// browserId returns the id of the requesting browser, issuing one when the
+// browser has none yet
+func (bt *browserTracker) browserId(w http.ResponseWriter, r *http.Request) string {
+	if c, err := r.Cookie(bt.cookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return ""
+	}
+	id := hex.EncodeToString(buf)
+	http.SetCookie(w, &http.Cookie{
+		Name:     bt.cookie,
+		Value:    id,
+		Path:     "/",
+		HttpOnly: true,
+	})
+	return id
+}
+
+func (bt *browserTracker) acquire(id string) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	bt.polls[id]++
+}
+
+func (bt *browserTracker) release(id string) {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	if bt.polls[id] <= 1 {
+		delete(bt.polls, id)
+	} else {
+		bt.polls[id]--
+	}
+}
+
+func (bt *browserTracker) multipleClients(id string) bool {
+	bt.mutex.Lock()
+	defer bt.mutex.Unlock()
+	return bt.polls[id] > 1
+}
+
+func containsConnect(body interface{}) bool {
+	isConnect := func(v interface{}) bool {
+		m, ok := v.(map[string]interface{})
+		return ok && protocol.Message(m).Channel().MetaType() == protocol.MetaConnectChannel
+	}
+	if arr, ok := body.([]interface{}); ok {
+		for _, v := range arr {
+			if isConnect(v) {
+				return true
+			}
+		}
+		return false
+	}
+	return isConnect(body)
+}
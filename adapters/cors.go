@@ -0,0 +1,115 @@
+package adapters
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type CORSOptions struct {
+	// Origins allowed to make cross-origin requests, "*" allows any and
+	// can't be combined with AllowCredentials
+	AllowedOrigins []string
+	// Decides on origins not listed in AllowedOrigins
+	AllowOriginFunc func(origin string) bool
+	// Whether cookies may accompany cross-origin requests, only from the
+	// origins listed or allowed by AllowOriginFunc
+	AllowCredentials bool
+	// Request headers allowed in cross-origin requests, defaults to
+	// DefaultCORSHeaders
+	AllowedHeaders []string
+	// How long browsers may cache a preflight response
+	MaxAge time.Duration
+}
+
+var DefaultCORSHeaders = []string{"Accept", "Authorization", "Content-Type", "Pragma", "X-Requested-With"}
+
+// Methods the polling transports accept, see decode
+const corsMethods = "GET, POST, PUT, OPTIONS"
+
+// Validate reports policies that can't be enforced safely. Allowing
+// credentials from any origin would let every site act with the user's
+// cookies, so it has to list the origins instead.
+func (c *CORSOptions) Validate() error {
+	if c.allowsAny() && c.AllowCredentials {
+		return errors.New(`cors: AllowedOrigins "*" can't be combined with AllowCredentials`)
+	}
+	return nil
+}
+
+func (c *CORSOptions) allowsAny() bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORSOptions) allowed(origin string) bool {
+	if c.allowsAny() {
+		return true
+	}
+	for _, o := range c.AllowedOrigins {
+		if strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return c.AllowOriginFunc != nil && c.AllowOriginFunc(origin)
+}
+
+// apply adds the CORS headers for r and reports whether r was a preflight
+// request that has been fully answered
+func (c *CORSOptions) apply(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin == "" || !c.allowed(origin) {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	if c.allowsAny() {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return false
+	}
+
+	headers := c.AllowedHeaders
+	if len(headers) == 0 {
+		headers = DefaultCORSHeaders
+	}
+	h.Set("Access-Control-Allow-Methods", corsMethods)
+	h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.MaxAge.Seconds())))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// checkOrigin applies the CORS policy to websocket upgrades, allowing same
+// origin requests like the default upgrader does
+func (c *CORSOptions) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	return c.allowed(origin)
+}
@@ -0,0 +1,152 @@
+package adapters
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCORS(t *testing.T) {
+	cors := &CORSOptions{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	}
+	options := DefaultHandlerOptions
+	options.CORS = cors
+	handler := FayeHandlerWithOptions(newTestServer(t), options)
+
+	tests := []struct {
+		name      string
+		method    string
+		origin    string
+		preflight bool
+		status    int
+		headers   map[string]string
+	}{
+		{
+			name:      "preflight from allowed origin",
+			method:    "OPTIONS",
+			origin:    "https://app.example.com",
+			preflight: true,
+			status:    http.StatusNoContent,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET, POST, PUT, OPTIONS",
+				"Access-Control-Allow-Headers":     strings.Join(DefaultCORSHeaders, ", "),
+				"Access-Control-Max-Age":           "600",
+			},
+		},
+		{
+			name:      "preflight from other origin",
+			method:    "OPTIONS",
+			origin:    "https://evil.example.com",
+			preflight: true,
+			status:    http.StatusForbidden,
+			headers:   map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+		{
+			name:   "post from allowed origin",
+			method: "POST",
+			origin: "https://app.example.com",
+			status: http.StatusOK,
+			headers: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "",
+			},
+		},
+		{
+			name:    "post from other origin",
+			method:  "POST",
+			origin:  "https://evil.example.com",
+			status:  http.StatusOK,
+			headers: map[string]string{"Access-Control-Allow-Origin": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := strings.NewReader(`{"channel":"/meta/handshake","version":"1.0"}`)
+			r := httptest.NewRequest(tt.method, "/bayeux", body)
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", "POST")
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+			for k, v := range tt.headers {
+				if got := w.Header().Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSWildcard(t *testing.T) {
+	cors := &CORSOptions{AllowedOrigins: []string{"*"}}
+	r := httptest.NewRequest("POST", "/bayeux", nil)
+	r.Header.Set("Origin", "https://any.example.com")
+	w := httptest.NewRecorder()
+
+	if cors.apply(w, r) {
+		t.Fatalf("apply() treated a POST as preflight")
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+}
+
+func TestCORSWildcardWithCredentials(t *testing.T) {
+	cors := &CORSOptions{AllowedOrigins: []string{"*"}, AllowCredentials: true}
+	if err := cors.Validate(); err == nil {
+		t.Fatalf("Validate() accepted credentials from any origin")
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("FayeHandlerWithOptions() built a handler with the policy")
+		}
+	}()
+	options := DefaultHandlerOptions
+	options.CORS = cors
+	FayeHandlerWithOptions(newTestServer(t), options)
+}
+
+func TestCORSCheckOrigin(t *testing.T) {
+	cors := &CORSOptions{
+		AllowOriginFunc: func(origin string) bool { return strings.HasSuffix(origin, ".trusted.com") },
+	}
+
+	tests := []struct {
+		name     string
+		origin   string
+		expected bool
+	}{
+		{"no origin", "", true},
+		{"same origin", "http://example.com", true},
+		{"allowed by func", "https://app.trusted.com", true},
+		{"other origin", "https://evil.com", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "http://example.com/bayeux", nil)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if got := cors.checkOrigin(r); got != tt.expected {
+				t.Errorf("checkOrigin(%q) = %v, want %v", tt.origin, got, tt.expected)
+			}
+		})
+	}
+}
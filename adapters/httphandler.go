@@ -2,33 +2,195 @@ package adapters
 
 import (
 	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"path"
+	"strings"
+	"time"
 
 	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/protocol"
 	"github.com/dsablic/faye-go/transport"
 	"github.com/gorilla/websocket"
 )
 
 type CheckOriginFunc func(r *http.Request) bool
 
-func decode(r *http.Request) interface{} {
+// UpgraderOptions tunes the websocket upgrade and the memory held per
+// connection
+type UpgraderOptions struct {
+	// Sizes of the per-connection I/O buffers in bytes, zero uses the
+	// buffers of the HTTP server
+	ReadBufferSize  int
+	WriteBufferSize int
+	// Pool of write buffers shared between connections, so idle
+	// connections hold none
+	WriteBufferPool websocket.BufferPool
+	// Subprotocols supported by the server in order of preference
+	Subprotocols []string
+	// Negotiate permessage-deflate with clients that offer it
+	EnableCompression bool
+	// Time allowed to complete the upgrade, zero means no limit
+	HandshakeTimeout time.Duration
+}
+
+func (u UpgraderOptions) isZero() bool {
+	return u.ReadBufferSize == 0 && u.WriteBufferSize == 0 && u.WriteBufferPool == nil &&
+		len(u.Subprotocols) == 0 && !u.EnableCompression && u.HandshakeTimeout == 0
+}
+
+// HandlerOptions configures FayeHandlerWithOptions. Zero fields take their
+// value from DefaultHandlerOptions, so options that only set CORS keep the
+// default limits. Upgrader, Websocket and EventSource are defaulted as a
+// whole when left zero.
+type HandlerOptions struct {
+	// Websocket upgrade settings
+	Upgrader UpgraderOptions
+	// Websocket connection settings. MaxMessageSize bounds incoming frames,
+	// as sent on the wire when compression is negotiated.
+	Websocket transport.WebsocketOptions
+	// Event stream settings, such as the ping interval and write timeout
+	EventSource transport.EventSourceOptions
+	// Origin check applied to websocket upgrades, defaults to the CORS
+	// policy when one is set
+	CheckOrigin CheckOriginFunc
+	// Cross-origin policy for the HTTP transports, nil disables CORS
+	CORS *CORSOptions
+	// Cookie identifying a browser across its tabs, polling clients sharing
+	// a browser get the multiple-clients advice. Empty, the default, disables
+	// detection and no cookie is set.
+	BrowserCookie string
+	// Interval in milliseconds advised to clients sharing a browser
+	MultipleClientsInterval int
+	// Largest request body accepted in bytes, larger requests are answered
+	// with 413. A negative size disables the limit.
+	MaxBodySize int64
+}
+
+var DefaultHandlerOptions = HandlerOptions{
+	Upgrader: UpgraderOptions{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+	},
+	Websocket:               transport.DefaultWebsocketOptions,
+	EventSource:             transport.DefaultEventSourceOptions,
+	MultipleClientsInterval: 1000,
+	MaxBodySize:             1 << 20,
+}
+
+// withDefaults fills the zero fields of options from DefaultHandlerOptions
+func (options HandlerOptions) withDefaults() HandlerOptions {
+	if options.Upgrader.isZero() {
+		options.Upgrader = DefaultHandlerOptions.Upgrader
+	}
+	if options.Websocket == (transport.WebsocketOptions{}) {
+		options.Websocket = DefaultHandlerOptions.Websocket
+	}
+	if options.EventSource == (transport.EventSourceOptions{}) {
+		options.EventSource = DefaultHandlerOptions.EventSource
+	}
+	if options.MultipleClientsInterval == 0 {
+		options.MultipleClientsInterval = DefaultHandlerOptions.MultipleClientsInterval
+	}
+	if options.MaxBodySize == 0 {
+		options.MaxBodySize = DefaultHandlerOptions.MaxBodySize
+	}
+	return options
+}
+
+// requestError is a refused request, answered with its status
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+var (
+	errInvalidRequest       = &requestError{http.StatusBadRequest, "Invalid http request"}
+	errBodyTooLarge         = &requestError{http.StatusRequestEntityTooLarge, "Request body too large"}
+	errUnsupportedMediaType = &requestError{http.StatusUnsupportedMediaType, "Unsupported media type"}
+)
+
+func bodyError(err error) *requestError {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		return errBodyTooLarge
+	}
+	return errInvalidRequest
+}
+
+// decode reads the messages of a polling request. JSON is accepted as
+// application/json and as text/plain, which XHR clients send to avoid a
+// preflight, and form posts carry it in the message parameter.
+func decode(w http.ResponseWriter, r *http.Request, maxBodySize int64) (interface{}, *requestError) {
 	switch r.Method {
-	case "POST":
+	case "POST", "PUT":
 	case "GET":
-	case "PUT":
+		return decodeMessageParam(r.URL.Query().Get("message"))
 	default:
-		return nil
+		return nil, errInvalidRequest
+	}
+
+	if maxBodySize > 0 {
+		if r.ContentLength > maxBodySize {
+			return nil, errBodyTooLarge
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	}
+
+	mediaType := "application/x-www-form-urlencoded"
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		var params map[string]string
+		var err error
+		if mediaType, params, err = mime.ParseMediaType(ct); err != nil {
+			return nil, errUnsupportedMediaType
+		}
+		if charset, ok := params["charset"]; ok && !strings.EqualFold(charset, "utf-8") {
+			return nil, errUnsupportedMediaType
+		}
 	}
-	if ct := r.Header.Get("Content-Type"); ct == "application/json" {
+
+	switch mediaType {
+	case "application/json", "text/plain":
 		var v interface{}
-		dec := json.NewDecoder(r.Body)
-		if err := dec.Decode(&v); err == nil {
-			return v
+		if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+			return nil, bodyError(err)
+		}
+		if v == nil {
+			return nil, errInvalidRequest
+		}
+		return v, nil
+	case "application/x-www-form-urlencoded":
+		if err := r.ParseForm(); err != nil {
+			return nil, bodyError(err)
 		}
-		return nil
+		return decodeMessageParam(r.Form.Get("message"))
+	default:
+		return nil, errUnsupportedMediaType
 	}
-	r.ParseForm()
-	return r.Form
+}
+
+// Form posts and callback-polling GETs carry the JSON encoded messages in
+// the message parameter
+func decodeMessageParam(message string) (interface{}, *requestError) {
+	var v interface{}
+	if err := json.Unmarshal([]byte(message), &v); err != nil || v == nil {
+		return nil, errInvalidRequest
+	}
+	return v, nil
+}
+
+func isCallbackPolling(r *http.Request) bool {
+	return r.Method == "GET" && r.URL.Query().Get("jsonp") != ""
+}
+
+// Event streams are opened with a GET to <endpoint>/<clientId>
+func isEventSource(r *http.Request) bool {
+	return r.Method == "GET" && strings.Contains(r.Header.Get("Accept"), "text/event-stream")
 }
 
 func FayeHandler(server *faye.Server) http.Handler {
@@ -36,16 +198,73 @@ func FayeHandler(server *faye.Server) http.Handler {
 }
 
 func FayeHandlerWithCheckOrigin(server *faye.Server, checkOrigin CheckOriginFunc) http.Handler {
+	options := DefaultHandlerOptions
+	options.CheckOrigin = checkOrigin
+	return FayeHandlerWithOptions(server, options)
+}
+
+// FayeHandlerWithOptions serves every transport of server. It panics when
+// options.CORS fails validation, see CORSOptions.Validate.
+func FayeHandlerWithOptions(server *faye.Server, options HandlerOptions) http.Handler {
+	options = options.withDefaults()
+	if options.CORS != nil {
+		if err := options.CORS.Validate(); err != nil {
+			panic(err)
+		}
+	}
+	server.OfferConnectionTypes(
+		protocol.ConnectionTypeWebsocket,
+		protocol.ConnectionTypeEventSource,
+		protocol.ConnectionTypeLongPolling,
+		protocol.ConnectionTypeCallbackPolling,
+	)
+
 	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
+		ReadBufferSize:    options.Upgrader.ReadBufferSize,
+		WriteBufferSize:   options.Upgrader.WriteBufferSize,
+		WriteBufferPool:   options.Upgrader.WriteBufferPool,
+		Subprotocols:      options.Upgrader.Subprotocols,
+		EnableCompression: options.Upgrader.EnableCompression,
+		HandshakeTimeout:  options.Upgrader.HandshakeTimeout,
+	}
+	if options.CheckOrigin != nil {
+		upgrader.CheckOrigin = options.CheckOrigin
+	} else if options.CORS != nil {
+		upgrader.CheckOrigin = options.CORS.checkOrigin
+	}
+
+	var browsers *browserTracker
+	if options.BrowserCookie != "" {
+		browsers = newBrowserTracker(options.BrowserCookie)
 	}
-	if checkOrigin != nil {
-		upgrader.CheckOrigin = checkOrigin
+
+	// Polls holding a connect are counted per browser while they are open
+	pollOptions := func(w http.ResponseWriter, r *http.Request, body interface{}) (transport.PollOptions, func()) {
+		if browsers == nil || !containsConnect(body) {
+			return transport.PollOptions{}, func() {}
+		}
+		id := browsers.browserId(w, r)
+		if id == "" {
+			return transport.PollOptions{}, func() {}
+		}
+		browsers.acquire(id)
+		return transport.PollOptions{
+			MultipleClients:         func() bool { return browsers.multipleClients(id) },
+			MultipleClientsInterval: options.MultipleClientsInterval,
+		}, func() { browsers.release(id) }
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if options.CORS != nil && r.Header.Get("Upgrade") != "websocket" {
+			if preflight := options.CORS.apply(w, r); preflight {
+				return
+			}
+		}
+
 		if r.Header.Get("Upgrade") == "websocket" {
+			if options.Websocket.Stats != nil {
+				w = transport.CountWireBytes(w)
+			}
 			ws, err := upgrader.Upgrade(w, r, nil)
 			if _, ok := err.(websocket.HandshakeError); ok {
 				http.Error(w, "Not a websocket handshake", 400)
@@ -54,13 +273,33 @@ func FayeHandlerWithCheckOrigin(server *faye.Server, checkOrigin CheckOriginFunc
 				server.Logger().Errorf("Websocket upgrade error: %s", err)
 				return
 			}
-			transport.WebsocketServer(server)(ws)
+			transport.ServeWebsocket(server, ws, transport.PeerFromRequest(r), options.Websocket)
+		} else if isEventSource(r) {
+			conn := transport.NewEventSourceConnection(options.EventSource)
+			conn.SetPeer(transport.PeerFromRequest(r))
+			if !server.AttachConnection(path.Base(r.URL.Path), conn) {
+				http.Error(w, "Unknown client", 400)
+				return
+			}
+			conn.Serve(w, r, server.Logger())
+		} else if isCallbackPolling(r) {
+			query := r.URL.Query()
+			if body, err := decodeMessageParam(query.Get("message")); err == nil {
+				pollOpts, release := pollOptions(w, r, body)
+				defer release()
+				transport.MakeCallbackPollWithOptions(body, query.Get("jsonp"), server, w, r, pollOpts)
+			} else {
+				http.Error(w, err.message, err.status)
+				server.Logger().Debugf("Couldn't decode callback-polling request: %v", r)
+			}
 		} else {
-			if body := decode(r); body != nil {
-				transport.MakeLongPoll(body, server, w)
+			if body, err := decode(w, r, options.MaxBodySize); err == nil {
+				pollOpts, release := pollOptions(w, r, body)
+				defer release()
+				transport.MakeLongPollWithOptions(body, server, w, r, pollOpts)
 			} else {
-				http.Error(w, "Invalid http request", 400)
-				server.Logger().Debugf("Couldn't decode request body: %v", r)
+				http.Error(w, err.message, err.status)
+				server.Logger().Debugf("Couldn't decode request body: %s", err)
 			}
 		}
 	})
@@ -0,0 +1,385 @@
+package adapters
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/transport"
+	"github.com/gorilla/websocket"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Panicf(string, ...interface{}) {}
+
+type allowAll struct{}
+
+func (allowAll) SubscribeValid(*protocol.Message) bool { return true }
+func (allowAll) PublishValid(*protocol.Message) bool   { return true }
+
+func newTestServer(t *testing.T) *faye.Server {
+	engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+	t.Cleanup(engine.Close)
+	return faye.NewServer(nopLogger{}, engine, allowAll{})
+}
+
+type testClient struct {
+	t       *testing.T
+	url     string
+	cookies []*http.Cookie
+}
+
+func (tc *testClient) post(body string) (*http.Response, []protocol.Message) {
+	tc.t.Helper()
+	req, _ := http.NewRequest("POST", tc.url, bytes.NewBufferString(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range tc.cookies {
+		req.AddCookie(c)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tc.t.Fatalf("POST: %v", err)
+	}
+	defer resp.Body.Close()
+	if cookies := resp.Cookies(); len(cookies) > 0 {
+		tc.cookies = cookies
+	}
+	var msgs []protocol.Message
+	json.NewDecoder(resp.Body).Decode(&msgs)
+	return resp, msgs
+}
+
+func (tc *testClient) handshake() string {
+	tc.t.Helper()
+	_, msgs := tc.post(`{"channel":"/meta/handshake","version":"1.0"}`)
+	if len(msgs) == 0 {
+		tc.t.Fatalf("empty handshake response")
+	}
+	clientId, ok := msgs[0]["clientId"].(string)
+	if !ok {
+		tc.t.Fatalf("handshake failed: %v", msgs)
+	}
+	return clientId
+}
+
+func connectAdvice(msgs []protocol.Message) map[string]interface{} {
+	for _, msg := range msgs {
+		if msg.Channel().Name() == "/meta/connect" {
+			advice, _ := msg["advice"].(map[string]interface{})
+			return advice
+		}
+	}
+	return nil
+}
+
+func TestMultipleClientsAdvice(t *testing.T) {
+	options := DefaultHandlerOptions
+	options.BrowserCookie = "BAYEUX_BROWSER"
+	srv := httptest.NewServer(FayeHandlerWithOptions(newTestServer(t), options))
+	defer srv.Close()
+	browser := &testClient{t: t, url: srv.URL}
+
+	publisher := (&testClient{t: t, url: srv.URL}).handshake()
+	publish := func(channel string) {
+		(&testClient{t: t, url: srv.URL}).post(`{"channel":"` + channel + `","clientId":"` + publisher + `","data":"hi"}`)
+	}
+	connect := func(clientId string) <-chan []protocol.Message {
+		result := make(chan []protocol.Message, 1)
+		go func() {
+			_, msgs := browser.post(`{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}`)
+			result <- msgs
+		}()
+		return result
+	}
+
+	// The first poll issues the browser its cookie
+	tab1 := browser.handshake()
+	browser.post(`{"channel":"/meta/subscribe","clientId":"` + tab1 + `","subscription":"/tab1"}`)
+	poll := connect(tab1)
+	time.Sleep(50 * time.Millisecond)
+	publish("/tab1")
+	<-poll
+	if len(browser.cookies) == 0 {
+		t.Fatalf("no browser cookie issued")
+	}
+
+	tab2 := browser.handshake()
+	browser.post(`{"channel":"/meta/subscribe","clientId":"` + tab2 + `","subscription":"/tab2"}`)
+
+	poll1 := connect(tab1)
+	poll2 := connect(tab2)
+	time.Sleep(50 * time.Millisecond)
+
+	publish("/tab1")
+	advice := connectAdvice(<-poll1)
+	if advice["multiple-clients"] != true {
+		t.Errorf("advice = %v, want multiple-clients while another tab polls", advice)
+	}
+	if advice["interval"] != float64(DefaultHandlerOptions.MultipleClientsInterval) {
+		t.Errorf("interval = %v, want %d", advice["interval"], DefaultHandlerOptions.MultipleClientsInterval)
+	}
+
+	publish("/tab2")
+	if advice := connectAdvice(<-poll2); advice["multiple-clients"] == true {
+		t.Errorf("advice = %v, want no multiple-clients for the only polling tab", advice)
+	}
+}
+
+func TestBatchedConnectWithQueuedMessages(t *testing.T) {
+	srv := httptest.NewServer(FayeHandler(newTestServer(t)))
+	defer srv.Close()
+	client := &testClient{t: t, url: srv.URL}
+	clientId := client.handshake()
+	publisher := (&testClient{t: t, url: srv.URL}).handshake()
+	publish := func(text string) {
+		(&testClient{t: t, url: srv.URL}).post(`{"channel":"/chat","clientId":"` + publisher + `","data":"` + text + `"}`)
+	}
+
+	client.post(`{"channel":"/meta/subscribe","clientId":"` + clientId + `","subscription":"/chat"}`)
+	held := make(chan []protocol.Message, 1)
+	go func() {
+		_, msgs := client.post(`{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}`)
+		held <- msgs
+	}()
+	// Publish until the held connect returns, later publishes are queued
+	// for the next poll
+	for released := false; !released; {
+		publish("first")
+		select {
+		case <-held:
+			released = true
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	publish("second")
+	publish("third")
+
+	_, msgs := client.post(`[{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"},
+		{"channel":"/meta/subscribe","clientId":"` + clientId + `","subscription":"/other","id":"sub"}]`)
+	var data []interface{}
+	var connected bool
+	var subscribed protocol.Message
+	for _, msg := range msgs {
+		switch msg.Channel().Name() {
+		case "/chat":
+			data = append(data, msg["data"])
+		case "/meta/connect":
+			connected = msg["successful"] == true
+		case "/meta/subscribe":
+			subscribed = msg
+		}
+	}
+	// A publish racing the release of the first connect may be queued too
+	if n := len(data); n < 2 || !reflect.DeepEqual(data[n-2:], []interface{}{"second", "third"}) {
+		t.Errorf("queued messages = %v, want second and third", data)
+	}
+	if !connected {
+		t.Errorf("no connect reply in %v", msgs)
+	}
+	if subscribed["id"] != "sub" || subscribed["successful"] != true {
+		t.Errorf("subscribe reply = %v, want it in the batch response", subscribed)
+	}
+}
+
+func TestDecodeRequestBody(t *testing.T) {
+	handshake := `{"channel":"/meta/handshake","version":"1.0"}`
+	options := DefaultHandlerOptions
+	options.MaxBodySize = 256
+	handler := FayeHandlerWithOptions(newTestServer(t), options)
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		status      int
+	}{
+		{"json", "POST", "/bayeux", "application/json", handshake, http.StatusOK},
+		{"json with charset", "POST", "/bayeux", "application/json; charset=utf-8", handshake, http.StatusOK},
+		{"text/plain", "POST", "/bayeux", "text/plain;charset=UTF-8", handshake, http.StatusOK},
+		{"form", "POST", "/bayeux", "application/x-www-form-urlencoded", "message=" + url.QueryEscape(handshake), http.StatusOK},
+		{"query", "GET", "/bayeux?message=" + url.QueryEscape(handshake), "", "", http.StatusOK},
+		{"invalid json", "POST", "/bayeux", "application/json", "{", http.StatusBadRequest},
+		{"null json", "POST", "/bayeux", "application/json", "null", http.StatusBadRequest},
+		{"missing message", "POST", "/bayeux", "application/x-www-form-urlencoded", "other=1", http.StatusBadRequest},
+		{"unsupported media type", "POST", "/bayeux", "application/xml", "<message/>", http.StatusUnsupportedMediaType},
+		{"unsupported charset", "POST", "/bayeux", "application/json; charset=latin1", handshake, http.StatusUnsupportedMediaType},
+		{"malformed content type", "POST", "/bayeux", "application/json; charset", handshake, http.StatusUnsupportedMediaType},
+		{"json too large", "POST", "/bayeux", "application/json", `{"data":"` + strings.Repeat("x", 300) + `"}`, http.StatusRequestEntityTooLarge},
+		{"form too large", "POST", "/bayeux", "application/x-www-form-urlencoded", "message=" + strings.Repeat("x", 300), http.StatusRequestEntityTooLarge},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d: %s", w.Code, tt.status, w.Body)
+			}
+			if tt.status != http.StatusOK {
+				return
+			}
+			var msgs []protocol.Message
+			if err := json.Unmarshal(w.Body.Bytes(), &msgs); err != nil || len(msgs) == 0 || msgs[0]["clientId"] == nil {
+				t.Errorf("response = %s, want a handshake reply", w.Body)
+			}
+		})
+	}
+}
+
+func TestDecodeUnknownLength(t *testing.T) {
+	options := DefaultHandlerOptions
+	options.MaxBodySize = 64
+	handler := FayeHandlerWithOptions(newTestServer(t), options)
+
+	// Chunked bodies carry no Content-Length and are cut off while reading
+	r := httptest.NewRequest("POST", "/bayeux", strings.NewReader(`{"data":"`+strings.Repeat("x", 100)+`"}`))
+	r.ContentLength = -1
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestHandlerOptionsDefaults(t *testing.T) {
+	options := HandlerOptions{CORS: &CORSOptions{AllowedOrigins: []string{"https://app.example.com"}}}.withDefaults()
+	if options.Websocket != DefaultHandlerOptions.Websocket {
+		t.Errorf("Websocket = %+v, want the defaults", options.Websocket)
+	}
+	if options.EventSource != DefaultHandlerOptions.EventSource {
+		t.Errorf("EventSource = %+v, want the defaults", options.EventSource)
+	}
+	if options.Upgrader.ReadBufferSize != DefaultHandlerOptions.Upgrader.ReadBufferSize {
+		t.Errorf("Upgrader = %+v, want the defaults", options.Upgrader)
+	}
+	if options.MaxBodySize != DefaultHandlerOptions.MaxBodySize || options.MultipleClientsInterval != DefaultHandlerOptions.MultipleClientsInterval {
+		t.Errorf("MaxBodySize = %d, MultipleClientsInterval = %d, want the defaults", options.MaxBodySize, options.MultipleClientsInterval)
+	}
+
+	set := HandlerOptions{
+		Websocket:   transport.WebsocketOptions{MaxMessageSize: 1024},
+		MaxBodySize: -1,
+	}.withDefaults()
+	if set.Websocket != (transport.WebsocketOptions{MaxMessageSize: 1024}) || set.MaxBodySize != -1 {
+		t.Errorf("withDefaults() replaced set options: %+v", set)
+	}
+
+	handler := FayeHandlerWithOptions(newTestServer(t), HandlerOptions{})
+	r := httptest.NewRequest("POST", "/bayeux", strings.NewReader(`{"data":"`+strings.Repeat("x", 2<<20)+`"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("status = %d with zero options, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestEventSourceOptions(t *testing.T) {
+	options := DefaultHandlerOptions
+	options.EventSource.PingInterval = 10 * time.Millisecond
+	srv := httptest.NewServer(FayeHandlerWithOptions(newTestServer(t), options))
+	defer srv.Close()
+	clientId := (&testClient{t: t, url: srv.URL}).handshake()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/"+clientId, nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	pinged := make(chan bool, 1)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			if scanner.Text() == ":" {
+				pinged <- true
+				return
+			}
+		}
+		pinged <- false
+	}()
+	select {
+	case ok := <-pinged:
+		if !ok {
+			t.Fatal("event stream ended without a ping")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no ping within a second, PingInterval was not applied")
+	}
+}
+
+func TestUpgraderOptions(t *testing.T) {
+	options := DefaultHandlerOptions
+	options.Upgrader.Subprotocols = []string{"bayeux"}
+	options.Upgrader.EnableCompression = true
+	options.Upgrader.WriteBufferPool = &sync.Pool{}
+	options.Websocket.MaxMessageSize = 128
+	srv := httptest.NewServer(FayeHandlerWithOptions(newTestServer(t), options))
+	defer srv.Close()
+
+	dialer := websocket.Dialer{Subprotocols: []string{"bayeux"}, EnableCompression: true}
+	ws, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer ws.Close()
+
+	if got := ws.Subprotocol(); got != "bayeux" {
+		t.Errorf("subprotocol = %q, want bayeux", got)
+	}
+	if ext := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Errorf("extensions = %q, want permessage-deflate", ext)
+	}
+
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := ws.WriteJSON(protocol.Message{"channel": "/meta/handshake", "version": "1.0"}); err != nil {
+		t.Fatalf("WriteJSON: %v", err)
+	}
+	var msgs []protocol.Message
+	if err := ws.ReadJSON(&msgs); err != nil || len(msgs) == 0 || msgs[0]["clientId"] == nil {
+		t.Fatalf("handshake reply = %v, %v", msgs, err)
+	}
+
+	// Messages over MaxMessageSize close the connection. The limit applies
+	// to the compressed frame, so the payload must not compress well.
+	noise := make([]byte, 512)
+	rand.Read(noise)
+	ws.WriteJSON(protocol.Message{"channel": "/meta/handshake", "data": hex.EncodeToString(noise)})
+	for {
+		if _, _, err = ws.ReadMessage(); err != nil {
+			break
+		}
+	}
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("read after oversized message = %v, want close 1009", err)
+	}
+}
@@ -0,0 +1,186 @@
+package adapters
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/transport"
+)
+
+// TokenVerifier returns the principal of a bearer token,
+// auth.JWTAuthenticator is one
+type TokenVerifier interface {
+	Verify(token string) (*protocol.Principal, error)
+}
+
+type PublishHandlerOptions struct {
+	// Verifies bearer tokens that are not a publish secret of the server,
+	// the principal is authorized like a client's. Nil only accepts secrets.
+	Tokens TokenVerifier
+	// Largest accepted request body in bytes, zero means no limit
+	MaxBodySize int64
+	// Most messages in one request, zero means no limit
+	MaxBatchSize int
+}
+
+var DefaultPublishHandlerOptions = PublishHandlerOptions{
+	MaxBodySize:  1 << 20,
+	MaxBatchSize: 100,
+}
+
+// PublishResult reports the outcome of one published message
+type PublishResult struct {
+	Channel    string `json:"channel"`
+	Id         string `json:"id,omitempty"`
+	Successful bool   `json:"successful"`
+	Error      string `json:"error,omitempty"`
+}
+
+var (
+	errUnauthorized    = &requestError{http.StatusUnauthorized, "Unauthorized"}
+	errTooManyMessages = &requestError{http.StatusRequestEntityTooLarge, "Too many messages"}
+)
+
+// PublishHandler lets services that do not speak Bayeux publish with a
+// POST of {"channel": ..., "data": ...}, or an array of them. Requests
+// authenticate with "Authorization: Bearer <credential>", where the
+// credential is a publish secret of the server or a token accepted by
+// options.Tokens. The response holds a PublishResult for each message, in
+// the shape of the request.
+func PublishHandler(server *faye.Server, options PublishHandlerOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		publisher, err := authenticatePublisher(server, options.Tokens, r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.message, err.status)
+			return
+		}
+		body, err := decode(w, r, options.MaxBodySize)
+		if err != nil {
+			http.Error(w, err.message, err.status)
+			return
+		}
+
+		var messages []interface{}
+		batch, isBatch := body.([]interface{})
+		if isBatch {
+			messages = batch
+		} else {
+			messages = []interface{}{body}
+		}
+		if options.MaxBatchSize > 0 && len(messages) > options.MaxBatchSize {
+			http.Error(w, errTooManyMessages.message, errTooManyMessages.status)
+			return
+		}
+
+		conn := &publishConnection{peer: transport.PeerFromRequest(r)}
+		results := make([]PublishResult, len(messages))
+		for i, m := range messages {
+			results[i] = publishOne(server, publisher, conn, m)
+		}
+
+		if isBatch {
+			writeJSON(w, http.StatusOK, results)
+		} else {
+			writeJSON(w, http.StatusOK, results[0])
+		}
+	})
+}
+
+func authenticatePublisher(server *faye.Server, tokens TokenVerifier, r *http.Request) (faye.Publisher, *requestError) {
+	scheme, credential, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	credential = strings.TrimSpace(credential)
+	if !strings.EqualFold(scheme, "Bearer") || credential == "" {
+		return faye.Publisher{}, errUnauthorized
+	}
+	if server.IsPublishSecret(credential) {
+		return faye.Publisher{Trusted: true}, nil
+	}
+	if tokens == nil {
+		return faye.Publisher{}, errUnauthorized
+	}
+	principal, err := tokens.Verify(credential)
+	if err != nil {
+		server.Logger().Debugf("Publish request from %s refused: %v", r.RemoteAddr, err)
+		return faye.Publisher{}, errUnauthorized
+	}
+	return faye.Publisher{Principal: principal}, nil
+}
+
+// publishOne publishes a message of the request body. Only the channel,
+// data, id and ext are taken from it, publishes never act for a client.
+func publishOne(server *faye.Server, publisher faye.Publisher, conn *publishConnection, m interface{}) PublishResult {
+	fields, _ := m.(map[string]interface{})
+	name, _ := fields["channel"].(string)
+	id, _ := fields["id"].(string)
+	result := PublishResult{Channel: name, Id: id}
+
+	channel := protocol.NewChannel(name)
+	if fields == nil || !strings.HasPrefix(name, "/") || channel.IsMeta() || channel.IsService() || channel.IsWildcard() {
+		result.Error = "400:" + name + ":Invalid channel"
+		return result
+	}
+	if _, ok := fields["data"]; !ok {
+		result.Error = "400:" + name + ":Missing data"
+		return result
+	}
+
+	msg := protocol.Message{"channel": name, "data": fields["data"]}
+	if id != "" {
+		msg["id"] = id
+	}
+	if ext, ok := fields["ext"].(map[string]interface{}); ok {
+		msg["ext"] = ext
+	}
+	server.PublishFrom(&msg, publisher, conn)
+
+	response := conn.take()
+	result.Successful = response["successful"] == true
+	if !result.Successful {
+		result.Error, _ = response["error"].(string)
+	}
+	return result
+}
+
+// publishConnection collects the response to a publish made over plain
+// HTTP
+type publishConnection struct {
+	mutex     sync.Mutex
+	peer      protocol.PeerInfo
+	responses []protocol.Message
+}
+
+func (pc *publishConnection) Send(msgs []protocol.Message) error {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	pc.responses = append(pc.responses, msgs...)
+	return nil
+}
+
+func (pc *publishConnection) IsConnected() bool { return true }
+
+func (pc *publishConnection) IsSingleShot() bool { return true }
+
+func (pc *publishConnection) Close() {}
+
+func (pc *publishConnection) Peer() protocol.PeerInfo { return pc.peer }
+
+// take returns the last response sent and forgets the others
+func (pc *publishConnection) take() protocol.Message {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+	if len(pc.responses) == 0 {
+		return protocol.Message{}
+	}
+	last := pc.responses[len(pc.responses)-1]
+	pc.responses = nil
+	return last
+}
@@ -0,0 +1,173 @@
+package adapters
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/auth"
+)
+
+func TestPublishHandler(t *testing.T) {
+	key := []byte("key")
+	token, _ := auth.SignHS256(map[string]interface{}{"sub": "42"}, "", key)
+	engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+	t.Cleanup(engine.Close)
+	server := faye.NewServerWithOptions(nopLogger{}, engine, allowAll{}, faye.ServerOptions{
+		Authorizer: auth.Rules{{Pattern: "/users/{sub}/**", Publish: true}},
+	})
+	options := DefaultPublishHandlerOptions
+	options.Tokens = &auth.JWTAuthenticator{Keys: auth.StaticKey(key)}
+	options.MaxBatchSize = 3
+	ts := httptest.NewServer(PublishHandler(server, options))
+	defer ts.Close()
+
+	tests := []struct {
+		name          string
+		authorization string
+		body          string
+		status        int
+		results       interface{}
+	}{
+		{
+			name:          "single",
+			authorization: "Bearer " + token,
+			body:          `{"channel": "/users/42/inbox", "data": "hi", "id": "1"}`,
+			status:        http.StatusOK,
+			results:       map[string]interface{}{"channel": "/users/42/inbox", "id": "1", "successful": true},
+		},
+		{
+			name:          "batch",
+			authorization: "Bearer " + token,
+			body: `[{"channel": "/users/42/inbox", "data": "hi"},
+				{"channel": "/users/43/inbox", "data": "hi"},
+				{"channel": "/meta/connect", "data": "hi"}]`,
+			status: http.StatusOK,
+			results: []interface{}{
+				map[string]interface{}{"channel": "/users/42/inbox", "successful": true},
+				map[string]interface{}{"channel": "/users/43/inbox", "successful": false, "error": "403:/users/43/inbox:Forbidden"},
+				map[string]interface{}{"channel": "/meta/connect", "successful": false, "error": "400:/meta/connect:Invalid channel"},
+			},
+		},
+		{
+			name:          "missing data",
+			authorization: "Bearer " + token,
+			body:          `{"channel": "/users/42/inbox"}`,
+			status:        http.StatusOK,
+			results:       map[string]interface{}{"channel": "/users/42/inbox", "successful": false, "error": "400:/users/42/inbox:Missing data"},
+		},
+		{"batch too large", "Bearer " + token, `[{}, {}, {}, {}]`, http.StatusRequestEntityTooLarge, nil},
+		{"no credentials", "", `{"channel": "/users/42/inbox", "data": "hi"}`, http.StatusUnauthorized, nil},
+		{"bad token", "Bearer " + token + "x", `{"channel": "/users/42/inbox", "data": "hi"}`, http.StatusUnauthorized, nil},
+		{"invalid json", "Bearer " + token, `{"channel"`, http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.results == nil {
+				return
+			}
+			var results interface{}
+			if err := json.NewDecoder(resp.Body).Decode(&results); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(results, tt.results) {
+				t.Errorf("results = %v, want %v", results, tt.results)
+			}
+		})
+	}
+}
+
+func TestPublishHandlerSecrets(t *testing.T) {
+	engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+	t.Cleanup(engine.Close)
+	server := faye.NewServerWithOptions(nopLogger{}, engine, allowAll{}, faye.ServerOptions{
+		PublishSecrets: []string{"s3cret"},
+	})
+	ts := httptest.NewServer(PublishHandler(server, DefaultPublishHandlerOptions))
+	defer ts.Close()
+
+	publish := func(authorization string) int {
+		req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(`{"channel": "/news", "data": "hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", authorization)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := publish("Bearer s3cret"); status != http.StatusOK {
+		t.Errorf("publish with secret = %d", status)
+	}
+	if status := publish("Bearer guess"); status != http.StatusUnauthorized {
+		t.Errorf("publish with wrong secret = %d", status)
+	}
+	server.SetPublishSecrets([]string{"rotated"})
+	if status := publish("Bearer s3cret"); status != http.StatusUnauthorized {
+		t.Errorf("publish with retired secret = %d", status)
+	}
+}
+
+func TestPublishHandlerTokensWithSecrets(t *testing.T) {
+	key := []byte("key")
+	token, _ := auth.SignHS256(map[string]interface{}{"sub": "42"}, "", key)
+	options := DefaultPublishHandlerOptions
+	options.Tokens = &auth.JWTAuthenticator{Keys: auth.StaticKey(key)}
+
+	publish := func(server *faye.Server, channel string) PublishResult {
+		ts := httptest.NewServer(PublishHandler(server, options))
+		defer ts.Close()
+		req, _ := http.NewRequest("POST", ts.URL, strings.NewReader(`{"channel": "`+channel+`", "data": "hi"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var result PublishResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	newServer := func(authorizer faye.Authorizer) *faye.Server {
+		engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+		t.Cleanup(engine.Close)
+		return faye.NewServerWithOptions(nopLogger{}, engine, allowAll{}, faye.ServerOptions{
+			PublishSecrets: []string{"s3cret"},
+			Authorizer:     authorizer,
+		})
+	}
+
+	server := newServer(auth.Rules{{Pattern: "/users/{sub}/**", Publish: true}})
+	if result := publish(server, "/users/42/inbox"); !result.Successful {
+		t.Errorf("authorized token publish = %+v", result)
+	}
+	if result := publish(server, "/users/43/inbox"); result.Error != "403:/users/43/inbox:Forbidden" {
+		t.Errorf("publish outside the rules = %+v", result)
+	}
+	if result := publish(newServer(nil), "/users/42/inbox"); result.Error != "403:/users/42/inbox:Forbidden" {
+		t.Errorf("token publish without an Authorizer = %+v", result)
+	}
+}
@@ -0,0 +1,258 @@
+package auth
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/utils"
+)
+
+const (
+	OperationSubscribe = "subscribe"
+	OperationPublish   = "publish"
+)
+
+// DefaultRolesClaim is the claim listing a principal's roles
+const DefaultRolesClaim = "roles"
+
+// Policy is the declarative form of an ACL. Field names are the same in
+// JSON and YAML documents.
+type Policy struct {
+	// Claim holding the principal's roles, a string or list of strings.
+	// Defaults to DefaultRolesClaim.
+	RolesClaim string       `json:"rolesClaim,omitempty" yaml:"rolesClaim,omitempty"`
+	Rules      []PolicyRule `json:"rules" yaml:"rules"`
+}
+
+// PolicyRule grants operations on the channels matching Channel, which may
+// contain {attribute} segments bound to the principal. A rule with roles
+// or claims only applies to principals having one of the roles and all of
+// the claim values.
+type PolicyRule struct {
+	Channel    string            `json:"channel" yaml:"channel"`
+	Operations []string          `json:"operations" yaml:"operations"`
+	Roles      []string          `json:"roles,omitempty" yaml:"roles,omitempty"`
+	Claims     map[string]string `json:"claims,omitempty" yaml:"claims,omitempty"`
+	// Grant the rule to anonymous clients too
+	Anonymous bool `json:"anonymous,omitempty" yaml:"anonymous,omitempty"`
+}
+
+// DecodeFunc decodes a policy document, such as json.Unmarshal. The package
+// has no YAML parser, YAML documents need a YAML package's Unmarshal.
+type DecodeFunc func(data []byte, v interface{}) error
+
+func (p Policy) validate() error {
+	for i, rule := range p.Rules {
+		if !strings.HasPrefix(rule.Channel, "/") {
+			return fmt.Errorf("rule %d: channel %q must start with /", i, rule.Channel)
+		}
+		for _, segment := range strings.Split(rule.Channel, "/") {
+			if strings.ContainsAny(segment, "{}") && !(strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") && len(segment) > 2) {
+				return fmt.Errorf("rule %d: template %q must be a whole segment", i, segment)
+			}
+		}
+		if len(rule.Operations) == 0 {
+			return fmt.Errorf("rule %d: no operations", i)
+		}
+		for _, op := range rule.Operations {
+			if op != OperationSubscribe && op != OperationPublish {
+				return fmt.Errorf("rule %d: unknown operation %q", i, op)
+			}
+		}
+	}
+	return nil
+}
+
+func (p Policy) allows(principal *protocol.Principal, channel, operation string) bool {
+	for _, rule := range p.Rules {
+		if !rule.grants(operation) || !p.appliesTo(rule, principal) {
+			continue
+		}
+		pattern, ok := ExpandPattern(rule.Channel, principal)
+		if ok && protocol.NewChannel(channel).Matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule PolicyRule) grants(operation string) bool {
+	for _, op := range rule.Operations {
+		if op == operation {
+			return true
+		}
+	}
+	return false
+}
+
+func (p Policy) appliesTo(rule PolicyRule, principal *protocol.Principal) bool {
+	if principal == nil {
+		return rule.Anonymous
+	}
+	for name, want := range rule.Claims {
+		if got, ok := principal.Attribute(name); !ok || got != want {
+			return false
+		}
+	}
+	if len(rule.Roles) == 0 {
+		return true
+	}
+	rolesClaim := p.RolesClaim
+	if rolesClaim == "" {
+		rolesClaim = DefaultRolesClaim
+	}
+	for _, role := range roles(principal.Claims[rolesClaim]) {
+		for _, want := range rule.Roles {
+			if role == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func roles(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return strings.Fields(v)
+	case []interface{}:
+		names := make([]string, 0, len(v))
+		for _, item := range v {
+			if name, ok := item.(string); ok {
+				names = append(names, name)
+			}
+		}
+		return names
+	case []string:
+		return v
+	}
+	return nil
+}
+
+// ACL authorizes subscribes and publishes by a Policy that can be replaced
+// while the server runs
+type ACL struct {
+	mutex  sync.RWMutex
+	policy Policy
+	path   string
+	decode DecodeFunc
+	loaded time.Time
+}
+
+func NewACL(policy Policy) (*ACL, error) {
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return &ACL{policy: policy}, nil
+}
+
+// LoadACL reads the policy at path, decode defaults to JSON
+func LoadACL(path string, decode DecodeFunc) (*ACL, error) {
+	if decode == nil {
+		decode = json.Unmarshal
+	}
+	acl := &ACL{path: path, decode: decode}
+	if err := acl.Reload(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+// Update replaces the policy, keeping the current one when policy is invalid
+func (a *ACL) Update(policy Policy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.policy = policy
+	return nil
+}
+
+// Reload reads the policy file again, keeping the current policy when the
+// file cannot be read or is invalid
+func (a *ACL) Reload() error {
+	if a.path == "" {
+		return fmt.Errorf("ACL was not loaded from a file")
+	}
+	info, err := os.Stat(a.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(a.path)
+	if err != nil {
+		return err
+	}
+	var policy Policy
+	if err := a.decode(data, &policy); err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	if err := a.Update(policy); err != nil {
+		return fmt.Errorf("%s: %w", a.path, err)
+	}
+	a.mutex.Lock()
+	a.loaded = info.ModTime()
+	a.mutex.Unlock()
+	return nil
+}
+
+// Watch reloads the policy file whenever its modification time changes,
+// checking every interval until stop is called. An invalid file is logged
+// and the current policy stays in place. An ACL made with NewACL has no file
+// to watch, Watch does nothing for it.
+func (a *ACL) Watch(interval time.Duration, logger utils.Logger) (stop func()) {
+	if a.path == "" {
+		return func() {}
+	}
+	done := make(chan struct{})
+	ticker := time.NewTicker(interval)
+	a.mutex.RLock()
+	seen := a.loaded
+	a.mutex.RUnlock()
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				info, err := os.Stat(a.path)
+				if err != nil {
+					logger.Warnf("Checking ACL %s: %s", a.path, err)
+					continue
+				}
+				if info.ModTime().Equal(seen) {
+					continue
+				}
+				// A broken file is reported once, not on every check
+				seen = info.ModTime()
+				if err := a.Reload(); err != nil {
+					logger.Errorf("Reloading ACL: %s", err)
+					continue
+				}
+				logger.Infof("Reloaded ACL %s", a.path)
+			}
+		}
+	}()
+	var once sync.Once
+	return func() { once.Do(func() { close(done) }) }
+}
+
+func (a *ACL) Policy() Policy {
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+	return a.policy
+}
+
+func (a *ACL) CanSubscribe(principal *protocol.Principal, channel string) bool {
+	return a.Policy().allows(principal, channel, OperationSubscribe)
+}
+
+func (a *ACL) CanPublish(principal *protocol.Principal, channel string) bool {
+	return a.Policy().allows(principal, channel, OperationPublish)
+}
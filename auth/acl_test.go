@@ -0,0 +1,158 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Panicf(string, ...interface{}) {}
+
+const testPolicy = `{
+	"rules": [
+		{"channel": "/users/{sub}/**", "operations": ["subscribe", "publish"]},
+		{"channel": "/admin/**", "operations": ["subscribe", "publish"], "roles": ["admin"]},
+		{"channel": "/tenants/{tenant}/reports", "operations": ["subscribe"], "claims": {"plan": "pro"}},
+		{"channel": "/public/*", "operations": ["subscribe"], "anonymous": true}
+	]
+}`
+
+func writePolicy(t *testing.T, path, policy string, mtime time.Time) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestACL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	writePolicy(t, path, testPolicy, time.Now())
+	acl, err := LoadACL(path, nil)
+	if err != nil {
+		t.Fatalf("LoadACL() = %v", err)
+	}
+
+	user := &protocol.Principal{Subject: "42", Claims: map[string]interface{}{"tenant": "acme", "plan": "free"}}
+	pro := &protocol.Principal{Subject: "43", Claims: map[string]interface{}{"tenant": "acme", "plan": "pro"}}
+	admin := &protocol.Principal{Subject: "1", Claims: map[string]interface{}{"roles": []interface{}{"staff", "admin"}}}
+
+	tests := []struct {
+		name      string
+		principal *protocol.Principal
+		channel   string
+		subscribe bool
+		publish   bool
+	}{
+		{"own channel", user, "/users/42/inbox", true, true},
+		{"other user", user, "/users/43/inbox", false, false},
+		{"admin channel without role", user, "/admin/audit", false, false},
+		{"admin channel with role", admin, "/admin/audit", true, true},
+		{"reports without plan", user, "/tenants/acme/reports", false, false},
+		{"reports with plan", pro, "/tenants/acme/reports", true, false},
+		{"reports of other tenant", pro, "/tenants/other/reports", false, false},
+		{"anonymous public", nil, "/public/news", true, false},
+		{"anonymous private", nil, "/users/42/inbox", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := acl.CanSubscribe(tt.principal, tt.channel); got != tt.subscribe {
+				t.Errorf("CanSubscribe(%q) = %v, want %v", tt.channel, got, tt.subscribe)
+			}
+			if got := acl.CanPublish(tt.principal, tt.channel); got != tt.publish {
+				t.Errorf("CanPublish(%q) = %v, want %v", tt.channel, got, tt.publish)
+			}
+		})
+	}
+}
+
+func TestACLInvalidPolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy Policy
+	}{
+		{"relative channel", Policy{Rules: []PolicyRule{{Channel: "users", Operations: []string{"subscribe"}}}}},
+		{"partial template", Policy{Rules: []PolicyRule{{Channel: "/users/id-{sub}", Operations: []string{"subscribe"}}}}},
+		{"no operations", Policy{Rules: []PolicyRule{{Channel: "/users"}}}},
+		{"unknown operation", Policy{Rules: []PolicyRule{{Channel: "/users", Operations: []string{"delete"}}}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := NewACL(tt.policy); err == nil {
+				t.Errorf("NewACL() accepted an invalid policy")
+			}
+		})
+	}
+}
+
+// failingLogger fails the test on warnings and errors
+type failingLogger struct {
+	nopLogger
+	t *testing.T
+}
+
+func (fl failingLogger) Warnf(format string, args ...interface{}) {
+	fl.t.Errorf("Warnf: "+format, args...)
+}
+
+func (fl failingLogger) Errorf(format string, args ...interface{}) {
+	fl.t.Errorf("Errorf: "+format, args...)
+}
+
+func TestACLWatchWithoutFile(t *testing.T) {
+	acl, err := NewACL(Policy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := acl.Watch(time.Millisecond, failingLogger{t: t})
+	time.Sleep(20 * time.Millisecond)
+	stop()
+}
+
+func TestACLWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl.json")
+	start := time.Now().Add(-time.Hour)
+	writePolicy(t, path, testPolicy, start)
+	acl, err := LoadACL(path, nil)
+	if err != nil {
+		t.Fatalf("LoadACL() = %v", err)
+	}
+	stop := acl.Watch(5*time.Millisecond, nopLogger{})
+	defer stop()
+
+	waitFor := func(allowed bool) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for acl.CanSubscribe(nil, "/status") != allowed {
+			if time.Now().After(deadline) {
+				t.Fatalf("CanSubscribe(/status) stayed %v", !allowed)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	writePolicy(t, path, `{"rules": [{"channel": "/status", "operations": ["subscribe"], "anonymous": true}]}`, start.Add(time.Minute))
+	waitFor(true)
+
+	// A broken update keeps the last good policy
+	writePolicy(t, path, `{"rules": [{"channel": "status"}]}`, start.Add(2*time.Minute))
+	time.Sleep(50 * time.Millisecond)
+	waitFor(true)
+
+	writePolicy(t, path, testPolicy, start.Add(3*time.Minute))
+	waitFor(false)
+}
@@ -0,0 +1,212 @@
+// Package auth authenticates handshakes with signed tokens and authorizes
+// subscribes and publishes against the resulting principal.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+var (
+	ErrMissingToken = errors.New("missing token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token expired")
+	// ErrNoKeySource is returned by an authenticator without Keys
+	ErrNoKeySource = errors.New("no key source configured")
+)
+
+// KeySource returns the HMAC key for the key id in a token header, which is
+// empty when the token names none
+type KeySource interface {
+	Key(kid string) ([]byte, error)
+}
+
+type KeySourceFunc func(kid string) ([]byte, error)
+
+func (f KeySourceFunc) Key(kid string) ([]byte, error) {
+	return f(kid)
+}
+
+// StaticKey verifies every token with key
+func StaticKey(key []byte) KeySource {
+	return KeySourceFunc(func(string) ([]byte, error) { return key, nil })
+}
+
+// KeySet verifies tokens with the key named by their kid, so keys can be
+// rotated by adding the new one before retiring the old
+type KeySet map[string][]byte
+
+func (ks KeySet) Key(kid string) ([]byte, error) {
+	if key, ok := ks[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key id %q", kid)
+}
+
+var algorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+// DefaultTokenField is the handshake ext field carrying the token
+const DefaultTokenField = "authToken"
+
+// JWTAuthenticator verifies an HMAC signed JSON Web Token carried in the
+// handshake ext, and makes its claims the principal of the client.
+type JWTAuthenticator struct {
+	// Keys verifying the signatures, every token is refused without them
+	Keys KeySource
+	// Ext field holding the token, defaults to DefaultTokenField
+	TokenField string
+	// Required iss and aud claims, empty accepts any
+	Issuer   string
+	Audience string
+	// Clock skew tolerated on exp and nbf
+	Leeway time.Duration
+	// Let clients without a token handshake anonymously. Invalid tokens
+	// are refused either way.
+	Optional bool
+
+	now func() time.Time
+}
+
+// Authenticate returns the principal of the token in the handshake ext, or
+// nil for an anonymous client when the token is optional
+func (ja *JWTAuthenticator) Authenticate(handshake *protocol.Message) (*protocol.Principal, error) {
+	field := ja.TokenField
+	if field == "" {
+		field = DefaultTokenField
+	}
+	ext, _ := (*handshake)["ext"].(map[string]interface{})
+	token, _ := ext[field].(string)
+	if token == "" {
+		if ja.Optional {
+			return nil, nil
+		}
+		return nil, ErrMissingToken
+	}
+	return ja.Verify(token)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Verify checks the signature and validity of token and returns its
+// principal
+func (ja *JWTAuthenticator) Verify(token string) (*protocol.Principal, error) {
+	if ja.Keys == nil {
+		return nil, ErrNoKeySource
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+	newHash, ok := algorithms[header.Alg]
+	if !ok {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidToken, header.Alg)
+	}
+	key, err := ja.Keys.Key(header.Kid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	mac := hmac.New(newHash, key)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, fmt.Errorf("%w: bad signature", ErrInvalidToken)
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if err := ja.validateClaims(claims); err != nil {
+		return nil, err
+	}
+	subject, _ := claims["sub"].(string)
+	return &protocol.Principal{Subject: subject, Claims: claims}, nil
+}
+
+func (ja *JWTAuthenticator) validateClaims(claims map[string]interface{}) error {
+	now := time.Now()
+	if ja.now != nil {
+		now = ja.now()
+	}
+	if exp, ok := claims["exp"].(float64); ok && now.Add(-ja.Leeway).After(time.Unix(int64(exp), 0)) {
+		return ErrExpiredToken
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(ja.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return fmt.Errorf("%w: not valid yet", ErrInvalidToken)
+	}
+	if ja.Issuer != "" && claims["iss"] != ja.Issuer {
+		return fmt.Errorf("%w: wrong issuer", ErrInvalidToken)
+	}
+	if ja.Audience != "" && !hasAudience(claims["aud"], ja.Audience) {
+		return fmt.Errorf("%w: wrong audience", ErrInvalidToken)
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch v := aud.(type) {
+	case string:
+		return v == audience
+	case []interface{}:
+		for _, item := range v {
+			if item == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	bs, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(bs, v)
+}
+
+// SignHS256 issues a token for claims, signed with key. It is meant for
+// tests and backends minting tokens for their own clients.
+func SignHS256(claims map[string]interface{}, kid string, key []byte) (string, error) {
+	header := map[string]string{"alg": "HS256", "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
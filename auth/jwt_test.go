@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+func handshakeWith(token string) *protocol.Message {
+	msg := protocol.Message{"channel": "/meta/handshake", "version": "1.0"}
+	if token != "" {
+		msg["ext"] = map[string]interface{}{DefaultTokenField: token}
+	}
+	return &msg
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	key := []byte("secret")
+	sign := func(claims map[string]interface{}, kid string, key []byte) string {
+		token, err := SignHS256(claims, kid, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	valid := map[string]interface{}{"sub": "42", "iss": "app", "aud": []interface{}{"faye"}, "exp": float64(now.Unix() + 60)}
+	with := func(k string, v interface{}) map[string]interface{} {
+		claims := map[string]interface{}{}
+		for name, value := range valid {
+			claims[name] = value
+		}
+		claims[k] = v
+		return claims
+	}
+	tampered := sign(valid, "", key)
+	tampered = tampered[:strings.LastIndex(tampered, ".")] + ".AAAA"
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"valid", sign(valid, "", key), nil},
+		{"missing", "", ErrMissingToken},
+		{"garbage", "not.a.token", ErrInvalidToken},
+		{"wrong key", sign(valid, "", []byte("other")), ErrInvalidToken},
+		{"tampered", tampered, ErrInvalidToken},
+		{"expired", sign(with("exp", float64(now.Unix()-120)), "", key), ErrExpiredToken},
+		{"expired within leeway", sign(with("exp", float64(now.Unix()-5)), "", key), nil},
+		{"not yet valid", sign(with("nbf", float64(now.Unix()+120)), "", key), ErrInvalidToken},
+		{"wrong issuer", sign(with("iss", "other"), "", key), ErrInvalidToken},
+		{"wrong audience", sign(with("aud", "other"), "", key), ErrInvalidToken},
+		{"unsigned", "eyJhbGciOiJub25lIn0.eyJzdWIiOiI0MiJ9.", ErrInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ja := &JWTAuthenticator{
+				Keys:     StaticKey(key),
+				Issuer:   "app",
+				Audience: "faye",
+				Leeway:   10 * time.Second,
+				now:      func() time.Time { return now },
+			}
+			principal, err := ja.Authenticate(handshakeWith(tt.token))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && principal.Subject != "42" {
+				t.Errorf("Subject = %q, want 42", principal.Subject)
+			}
+		})
+	}
+}
+
+func TestJWTAuthenticatorOptional(t *testing.T) {
+	ja := &JWTAuthenticator{Keys: StaticKey([]byte("secret")), Optional: true}
+	if principal, err := ja.Authenticate(handshakeWith("")); principal != nil || err != nil {
+		t.Errorf("Authenticate() without token = %v, %v, want anonymous", principal, err)
+	}
+	if _, err := ja.Authenticate(handshakeWith("bad")); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("Authenticate() with bad token = %v, want ErrInvalidToken", err)
+	}
+}
+
+func TestJWTAuthenticatorWithoutKeys(t *testing.T) {
+	token, _ := SignHS256(map[string]interface{}{"sub": "42"}, "", []byte("secret"))
+	ja := &JWTAuthenticator{}
+	if _, err := ja.Verify(token); !errors.Is(err, ErrNoKeySource) {
+		t.Errorf("Verify() without keys = %v, want ErrNoKeySource", err)
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	keys := KeySet{"2023": []byte("old"), "2024": []byte("new")}
+	ja := &JWTAuthenticator{Keys: keys}
+	for kid, key := range keys {
+		token, _ := SignHS256(map[string]interface{}{"sub": "1"}, kid, key)
+		if _, err := ja.Verify(token); err != nil {
+			t.Errorf("token signed with key %s refused: %v", kid, err)
+		}
+	}
+	token, _ := SignHS256(map[string]interface{}{"sub": "1"}, "2022", []byte("retired"))
+	if _, err := ja.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("token with retired key id = %v, want ErrInvalidToken", err)
+	}
+}
@@ -0,0 +1,68 @@
+package auth
+
+import (
+	"strings"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+// Rule grants the operations on channels matching Pattern. Segments in
+// braces are bound to principal attributes, so /users/{sub}/** grants each
+// user the channels under their own id.
+type Rule struct {
+	Pattern   string
+	Subscribe bool
+	Publish   bool
+	// Grant the rule to clients that did not authenticate. Rules with
+	// templated segments never apply to them.
+	AllowAnonymous bool
+}
+
+// Rules authorize a subscribe or publish when any rule grants it
+type Rules []Rule
+
+func (rs Rules) CanSubscribe(principal *protocol.Principal, channel string) bool {
+	return rs.allows(principal, channel, func(r Rule) bool { return r.Subscribe })
+}
+
+func (rs Rules) CanPublish(principal *protocol.Principal, channel string) bool {
+	return rs.allows(principal, channel, func(r Rule) bool { return r.Publish })
+}
+
+func (rs Rules) allows(principal *protocol.Principal, channel string, grants func(Rule) bool) bool {
+	for _, rule := range rs {
+		if !grants(rule) || (principal == nil && !rule.AllowAnonymous) {
+			continue
+		}
+		pattern, ok := ExpandPattern(rule.Pattern, principal)
+		if ok && protocol.NewChannel(channel).Matches(pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExpandPattern replaces the {attribute} segments of pattern with the
+// principal's attributes. It fails when an attribute is missing or is not
+// usable as a single channel segment.
+func ExpandPattern(pattern string, principal *protocol.Principal) (string, bool) {
+	if !strings.Contains(pattern, "{") {
+		return pattern, true
+	}
+	segments := strings.Split(pattern, "/")
+	for i, segment := range segments {
+		if !strings.HasPrefix(segment, "{") || !strings.HasSuffix(segment, "}") {
+			continue
+		}
+		value, ok := principal.Attribute(segment[1 : len(segment)-1])
+		if !ok || !isLiteralSegment(value) {
+			return "", false
+		}
+		segments[i] = value
+	}
+	return strings.Join(segments, "/"), true
+}
+
+func isLiteralSegment(s string) bool {
+	return s != "" && s != "*" && s != "**" && !strings.ContainsAny(s, "/{}")
+}
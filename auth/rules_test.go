@@ -0,0 +1,48 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+func TestRules(t *testing.T) {
+	rules := Rules{
+		{Pattern: "/users/{sub}/**", Subscribe: true, Publish: true},
+		{Pattern: "/tenants/{tenant}/*", Subscribe: true},
+		{Pattern: "/public/**", Subscribe: true, AllowAnonymous: true},
+	}
+	user := &protocol.Principal{Subject: "42", Claims: map[string]interface{}{"tenant": float64(7)}}
+	sneaky := &protocol.Principal{Subject: "*"}
+
+	tests := []struct {
+		name      string
+		principal *protocol.Principal
+		channel   string
+		subscribe bool
+		publish   bool
+	}{
+		{"own channel", user, "/users/42/inbox", true, true},
+		{"own wildcard", user, "/users/42/**", true, true},
+		{"other user", user, "/users/43/inbox", false, false},
+		{"all users", user, "/users/*/inbox", false, false},
+		{"numeric claim", user, "/tenants/7/news", true, false},
+		{"other tenant", user, "/tenants/8/news", false, false},
+		{"tenant wildcard too broad", user, "/tenants/7/**", false, false},
+		{"public", user, "/public/feed", true, false},
+		{"anonymous public", nil, "/public/feed", true, false},
+		{"anonymous templated", nil, "/users/42/inbox", false, false},
+		{"wildcard subject", sneaky, "/users/43/inbox", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rules.CanSubscribe(tt.principal, tt.channel); got != tt.subscribe {
+				t.Errorf("CanSubscribe(%q) = %v, want %v", tt.channel, got, tt.subscribe)
+			}
+			if got := rules.CanPublish(tt.principal, tt.channel); got != tt.publish {
+				t.Errorf("CanPublish(%q) = %v, want %v", tt.channel, got, tt.publish)
+			}
+		})
+	}
+}
@@ -0,0 +1,730 @@
+// Package client is a Bayeux client for faye servers. It handshakes, keeps
+// the session open with /meta/connect as advised by the server, and hands
+// the messages published to subscribed channels to callbacks.
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/utils"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrDisconnected is returned once the client was disconnected, by
+	// Disconnect or on the server's advice
+	ErrDisconnected = errors.New("client disconnected")
+	// ErrDropped is returned for requests an extension dropped
+	ErrDropped = errors.New("message dropped by an extension")
+)
+
+// Extension sees every message exchanged with the server, e.g. to add
+// credentials to ext. Returning nil drops the message.
+type Extension interface {
+	Outgoing(msg protocol.Message) protocol.Message
+	Incoming(msg protocol.Message) protocol.Message
+}
+
+type Options struct {
+	// Connection types in order of preference. A transport that cannot be
+	// opened, or that the server does not offer, falls back to the next.
+	Transports []string
+	// Client for long-polling requests, defaults to http.DefaultClient
+	HTTPClient *http.Client
+	// Dialer for websockets, defaults to websocket.DefaultDialer
+	Dialer *websocket.Dialer
+	// Sent with every HTTP request and websocket handshake
+	Header     http.Header
+	Extensions []Extension
+	Logger     utils.Logger
+	// Wait before retrying when the server advises no interval
+	RetryInterval time.Duration
+	// Time allowed for a response, on top of the advised timeout for
+	// /meta/connect
+	RequestTimeout time.Duration
+	// Messages received but not yet handed to callbacks, the transport
+	// stops reading while it is full
+	DeliveryQueueSize int
+}
+
+var DefaultOptions = Options{
+	Transports:        []string{protocol.ConnectionTypeWebsocket, protocol.ConnectionTypeLongPolling},
+	RetryInterval:     time.Second,
+	RequestTimeout:    10 * time.Second,
+	DeliveryQueueSize: 1000,
+}
+
+// Error is a request refused by the server, which formats its errors as
+// code:args:message
+type Error struct {
+	Code    int
+	Args    []string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Code == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%d:%s:%s", e.Code, strings.Join(e.Args, ","), e.Message)
+}
+
+func errorOf(response protocol.Message) *Error {
+	text, _ := response["error"].(string)
+	parts := strings.SplitN(text, ":", 3)
+	if len(parts) != 3 {
+		if text == "" {
+			text = "request failed"
+		}
+		return &Error{Message: text}
+	}
+	code, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return &Error{Message: text}
+	}
+	e := &Error{Code: code, Message: parts[2]}
+	if parts[1] != "" {
+		e.Args = strings.Split(parts[1], ",")
+	}
+	return e
+}
+
+// Client is a session with a faye server. It handshakes on first use and
+// handshakes again, restoring its subscriptions, whenever the server asks.
+type Client struct {
+	endpoint string
+	options  Options
+	logger   utils.Logger
+
+	// Serializes opening transports
+	transportMutex sync.Mutex
+
+	mutex         sync.Mutex
+	started       bool
+	established   bool
+	clientId      string
+	advice        protocol.Advice
+	supported     []string
+	transport     transport
+	subscriptions map[string][]*Subscription
+	pending       map[string]chan protocol.Message
+	nextId        uint64
+	// Closed while a session is established
+	ready chan struct{}
+	// Closed when the client stopped for good, err says why
+	stop       chan struct{}
+	stopOnce   sync.Once
+	err        error
+	deliveries chan protocol.Message
+}
+
+// Subscription delivers the messages of channels matching its pattern
+type Subscription struct {
+	client    *Client
+	pattern   string
+	callback  func(protocol.Message)
+	cancelled bool
+}
+
+func (s *Subscription) Pattern() string {
+	return s.pattern
+}
+
+func New(endpoint string) *Client {
+	return NewWithOptions(endpoint, DefaultOptions)
+}
+
+func NewWithOptions(endpoint string, options Options) *Client {
+	if len(options.Transports) == 0 {
+		options.Transports = DefaultOptions.Transports
+	}
+	if options.RetryInterval <= 0 {
+		options.RetryInterval = DefaultOptions.RetryInterval
+	}
+	if options.RequestTimeout <= 0 {
+		options.RequestTimeout = DefaultOptions.RequestTimeout
+	}
+	if options.DeliveryQueueSize <= 0 {
+		options.DeliveryQueueSize = DefaultOptions.DeliveryQueueSize
+	}
+	logger := options.Logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+	return &Client{
+		endpoint:      endpoint,
+		options:       options,
+		logger:        logger,
+		advice:        protocol.DefaultAdvice,
+		subscriptions: make(map[string][]*Subscription),
+		pending:       make(map[string]chan protocol.Message),
+		ready:         make(chan struct{}),
+		stop:          make(chan struct{}),
+		deliveries:    make(chan protocol.Message, options.DeliveryQueueSize),
+	}
+}
+
+// ClientId returns the id the server assigned, empty between sessions
+func (c *Client) ClientId() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.clientId
+}
+
+// Transport returns the connection type in use, empty when none is open
+func (c *Client) Transport() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.transport == nil {
+		return ""
+	}
+	return c.transport.name()
+}
+
+// Handshake starts the client and waits until it holds a session. Subscribe
+// and Publish call it, so calling it first is only needed to surface
+// handshake errors early.
+func (c *Client) Handshake(ctx context.Context) error {
+	c.mutex.Lock()
+	if !c.started {
+		c.started = true
+		go c.run()
+		go c.deliver()
+	}
+	ready := c.ready
+	c.mutex.Unlock()
+
+	select {
+	case <-ready:
+		return nil
+	case <-c.stop:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Subscribe calls callback with the messages published to channels matching
+// pattern, such as /chat/* or /chat/**. Callbacks run one at a time, in the
+// order messages arrive.
+func (c *Client) Subscribe(ctx context.Context, pattern string, callback func(protocol.Message)) (*Subscription, error) {
+	if err := c.Handshake(ctx); err != nil {
+		return nil, err
+	}
+	c.mutex.Lock()
+	subscribed := len(c.subscriptions[pattern]) > 0
+	c.mutex.Unlock()
+
+	if !subscribed {
+		response, err := c.request(ctx, protocol.Message{
+			"channel":      protocol.MetaPrefix + protocol.MetaSubscribeChannel,
+			"subscription": pattern,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if response["successful"] != true {
+			return nil, errorOf(response)
+		}
+	}
+
+	sub := &Subscription{client: c, pattern: pattern, callback: callback}
+	c.mutex.Lock()
+	c.subscriptions[pattern] = append(c.subscriptions[pattern], sub)
+	c.mutex.Unlock()
+	return sub, nil
+}
+
+// Cancel stops the subscription, the server is told once no subscription
+// is left for the pattern
+func (s *Subscription) Cancel(ctx context.Context) error {
+	c := s.client
+	c.mutex.Lock()
+	if s.cancelled {
+		c.mutex.Unlock()
+		return nil
+	}
+	s.cancelled = true
+	subs := c.subscriptions[s.pattern]
+	for i, sub := range subs {
+		if sub == s {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) > 0 {
+		c.subscriptions[s.pattern] = subs
+		c.mutex.Unlock()
+		return nil
+	}
+	delete(c.subscriptions, s.pattern)
+	established := c.established
+	c.mutex.Unlock()
+
+	if !established {
+		return nil
+	}
+	response, err := c.request(ctx, protocol.Message{
+		"channel":      protocol.MetaPrefix + protocol.MetaUnsubscribeChannel,
+		"subscription": s.pattern,
+	})
+	if err != nil {
+		return err
+	}
+	if response["successful"] != true {
+		return errorOf(response)
+	}
+	return nil
+}
+
+// Publish sends data to channel and waits for the server to accept it
+func (c *Client) Publish(ctx context.Context, channel string, data interface{}) error {
+	if err := c.Handshake(ctx); err != nil {
+		return err
+	}
+	response, err := c.request(ctx, protocol.Message{"channel": channel, "data": data})
+	if err != nil {
+		return err
+	}
+	if response["successful"] != true {
+		return errorOf(response)
+	}
+	return nil
+}
+
+// Disconnect ends the session, waiting for the server to confirm it, and
+// stops the client
+func (c *Client) Disconnect(ctx context.Context) error {
+	c.mutex.Lock()
+	clientId, t := c.clientId, c.transport
+	c.mutex.Unlock()
+
+	var err error
+	if clientId != "" && t != nil {
+		var response protocol.Message
+		response, err = c.request(ctx, protocol.Message{
+			"channel": protocol.MetaPrefix + protocol.MetaDisconnectChannel,
+		})
+		if err == nil && response["successful"] != true {
+			err = errorOf(response)
+		}
+	}
+	c.shutdown(ErrDisconnected)
+	return err
+}
+
+// run holds the session until the client stops
+func (c *Client) run() {
+	for !c.stopped() {
+		if c.ClientId() == "" {
+			if err := c.handshake(); err != nil {
+				c.logger.Warnf("Handshake with %s failed: %v", c.endpoint, err)
+				if c.currentAdvice().Reconnect == "none" {
+					c.shutdown(err)
+					return
+				}
+				c.wait(c.retryInterval())
+				continue
+			}
+			c.resubscribe()
+			continue
+		}
+		c.connect()
+	}
+}
+
+func (c *Client) handshake() error {
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.RequestTimeout)
+	defer cancel()
+
+	response, err := c.request(ctx, protocol.Message{
+		"channel":                  protocol.MetaPrefix + protocol.MetaHandshakeChannel,
+		"version":                  protocol.BayeuxVersion,
+		"supportedConnectionTypes": c.options.Transports,
+	})
+	if err != nil {
+		return err
+	}
+	c.updateAdvice(response)
+	if response["successful"] != true {
+		return errorOf(response)
+	}
+	clientId, _ := response["clientId"].(string)
+	if clientId == "" {
+		return fmt.Errorf("handshake response without clientId")
+	}
+
+	var supported []string
+	if types, ok := response["supportedConnectionTypes"].([]interface{}); ok {
+		for _, t := range types {
+			if name, ok := t.(string); ok {
+				supported = append(supported, name)
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	c.clientId = clientId
+	c.supported = supported
+	t := c.transport
+	if !c.established {
+		c.established = true
+		close(c.ready)
+	}
+	c.mutex.Unlock()
+
+	// Move to a transport the server offers
+	if t != nil && supported != nil && !contains(supported, t.name()) {
+		c.dropTransport(t)
+	}
+	c.logger.Debugf("Handshake with %s as %s", c.endpoint, clientId)
+	return nil
+}
+
+// resubscribe restores the subscriptions after a new handshake
+func (c *Client) resubscribe() {
+	c.mutex.Lock()
+	patterns := make([]string, 0, len(c.subscriptions))
+	for pattern := range c.subscriptions {
+		patterns = append(patterns, pattern)
+	}
+	c.mutex.Unlock()
+	if len(patterns) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.options.RequestTimeout)
+	defer cancel()
+	response, err := c.request(ctx, protocol.Message{
+		"channel":      protocol.MetaPrefix + protocol.MetaSubscribeChannel,
+		"subscription": patterns,
+	})
+	if err != nil {
+		c.logger.Warnf("Restoring subscriptions failed: %v", err)
+	} else if response["successful"] != true {
+		c.logger.Warnf("Restoring subscriptions failed: %v", errorOf(response))
+	}
+}
+
+// connect makes one /meta/connect and follows the advice of its response
+func (c *Client) connect() {
+	advice := c.currentAdvice()
+	timeout := time.Duration(advice.Timeout)*time.Millisecond + c.options.RequestTimeout
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	t, err := c.openTransports(ctx)
+	if err != nil {
+		c.logger.Warnf("Connecting to %s failed: %v", c.endpoint, err)
+		c.wait(c.retryInterval())
+		return
+	}
+	response, err := c.request(ctx, protocol.Message{
+		"channel":        protocol.MetaPrefix + protocol.MetaConnectChannel,
+		"connectionType": t.name(),
+	})
+	if err != nil {
+		if c.stopped() {
+			return
+		}
+		c.logger.Debugf("Connect on %s failed: %v", t.name(), err)
+		c.dropTransport(t)
+		c.wait(c.retryInterval())
+		return
+	}
+
+	c.updateAdvice(response)
+	advice = c.currentAdvice()
+	if response["successful"] == true {
+		c.wait(time.Duration(advice.Interval) * time.Millisecond)
+		return
+	}
+	switch advice.Reconnect {
+	case "none":
+		c.logger.Warnf("Server %s ended the session: %v", c.endpoint, errorOf(response))
+		c.shutdown(ErrDisconnected)
+	case "handshake":
+		c.logger.Debugf("Server %s asked for a new handshake", c.endpoint)
+		c.resetSession()
+	default:
+		c.wait(c.retryInterval())
+	}
+}
+
+func (c *Client) resetSession() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.clientId = ""
+	if c.established {
+		c.established = false
+		c.ready = make(chan struct{})
+	}
+}
+
+// openTransports returns the open transport, or opens the first one that
+// works among those the server offers
+func (c *Client) openTransports(ctx context.Context) (transport, error) {
+	c.transportMutex.Lock()
+	defer c.transportMutex.Unlock()
+
+	c.mutex.Lock()
+	current, supported := c.transport, c.supported
+	c.mutex.Unlock()
+	if current != nil {
+		select {
+		case <-current.closed():
+		default:
+			return current, nil
+		}
+	}
+
+	var lastErr error
+	for _, name := range c.options.Transports {
+		if supported != nil && !contains(supported, name) {
+			continue
+		}
+		t, err := c.openTransport(ctx, name, c.receive)
+		if err != nil {
+			c.logger.Debugf("Opening %s to %s failed: %v", name, c.endpoint, err)
+			lastErr = err
+			continue
+		}
+		c.mutex.Lock()
+		c.transport = t
+		c.mutex.Unlock()
+		if c.stopped() {
+			t.close()
+			return nil, c.err
+		}
+		return t, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("server offers none of %v", c.options.Transports)
+	}
+	return nil, lastErr
+}
+
+func (c *Client) dropTransport(t transport) {
+	t.close()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.transport == t {
+		c.transport = nil
+	}
+}
+
+// request sends msg and waits for the response with the same id
+func (c *Client) request(ctx context.Context, msg protocol.Message) (protocol.Message, error) {
+	t, err := c.openTransports(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	responses := make(chan protocol.Message, 1)
+	c.mutex.Lock()
+	c.nextId++
+	id := strconv.FormatUint(c.nextId, 10)
+	if msg.Channel().MetaType() != protocol.MetaHandshakeChannel {
+		msg["clientId"] = c.clientId
+	}
+	c.pending[id] = responses
+	c.mutex.Unlock()
+	defer func() {
+		c.mutex.Lock()
+		delete(c.pending, id)
+		c.mutex.Unlock()
+	}()
+
+	msg["id"] = id
+	if msg = c.outgoing(msg); msg == nil {
+		return nil, ErrDropped
+	}
+	if err := t.send(ctx, []protocol.Message{msg}); err != nil {
+		return nil, err
+	}
+
+	select {
+	case response := <-responses:
+		return response, nil
+	case <-t.closed():
+		select {
+		case response := <-responses:
+			return response, nil
+		default:
+			return nil, ErrTransportClosed
+		}
+	case <-c.stop:
+		return nil, c.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// receive hands responses to the requests waiting for them, and queues
+// published messages for the callbacks
+func (c *Client) receive(msgs []protocol.Message) {
+	for _, msg := range msgs {
+		if msg = c.incoming(msg); msg == nil {
+			continue
+		}
+		if _, published := msg["data"]; published && !msg.Channel().IsMeta() {
+			select {
+			case c.deliveries <- msg:
+			case <-c.stop:
+				return
+			}
+			continue
+		}
+
+		id, _ := msg["id"].(string)
+		c.mutex.Lock()
+		responses, ok := c.pending[id]
+		c.mutex.Unlock()
+		if !ok {
+			c.logger.Debugf("Unexpected message from %s: %v", c.endpoint, msg)
+			continue
+		}
+		select {
+		case responses <- msg:
+		default:
+		}
+	}
+}
+
+// deliver calls the callbacks of the subscriptions matching each message
+func (c *Client) deliver() {
+	for {
+		select {
+		case msg := <-c.deliveries:
+			channel := msg.Channel()
+			var callbacks []func(protocol.Message)
+			c.mutex.Lock()
+			for pattern, subs := range c.subscriptions {
+				if !channel.Matches(pattern) {
+					continue
+				}
+				for _, sub := range subs {
+					callbacks = append(callbacks, sub.callback)
+				}
+			}
+			c.mutex.Unlock()
+			for _, callback := range callbacks {
+				callback(msg)
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *Client) outgoing(msg protocol.Message) protocol.Message {
+	for _, ext := range c.options.Extensions {
+		if msg = ext.Outgoing(msg); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+func (c *Client) incoming(msg protocol.Message) protocol.Message {
+	for _, ext := range c.options.Extensions {
+		if msg = ext.Incoming(msg); msg == nil {
+			return nil
+		}
+	}
+	return msg
+}
+
+// updateAdvice applies the advice fields present in response
+func (c *Client) updateAdvice(response protocol.Message) {
+	advice, ok := response["advice"].(map[string]interface{})
+	if !ok {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if reconnect, ok := advice["reconnect"].(string); ok {
+		c.advice.Reconnect = reconnect
+	}
+	if interval, ok := advice["interval"].(float64); ok {
+		c.advice.Interval = int(interval)
+	}
+	if timeout, ok := advice["timeout"].(float64); ok {
+		c.advice.Timeout = int(timeout)
+	}
+}
+
+func (c *Client) currentAdvice() protocol.Advice {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.advice
+}
+
+func (c *Client) retryInterval() time.Duration {
+	if interval := c.currentAdvice().Interval; interval > 0 {
+		return time.Duration(interval) * time.Millisecond
+	}
+	return c.options.RetryInterval
+}
+
+func (c *Client) wait(d time.Duration) {
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-c.stop:
+	}
+}
+
+func (c *Client) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *Client) shutdown(err error) {
+	c.stopOnce.Do(func() {
+		c.mutex.Lock()
+		c.err = err
+		t := c.transport
+		c.transport = nil
+		c.clientId = ""
+		c.mutex.Unlock()
+		close(c.stop)
+		if t != nil {
+			t.close()
+		}
+	})
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Panicf(string, ...interface{}) {}
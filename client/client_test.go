@@ -0,0 +1,273 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go"
+	"github.com/dsablic/faye-go/adapters"
+	"github.com/dsablic/faye-go/auth"
+	"github.com/dsablic/faye-go/protocol"
+)
+
+type allowAll struct{}
+
+func (allowAll) SubscribeValid(*protocol.Message) bool { return true }
+func (allowAll) PublishValid(*protocol.Message) bool   { return true }
+
+func newTestServer(t *testing.T, engineOptions faye.EngineOptions, serverOptions faye.ServerOptions) (*httptest.Server, *faye.Engine) {
+	engine := faye.NewEngineWithOptions(nopLogger{}, time.Hour, make(chan faye.Counters, 1), engineOptions)
+	t.Cleanup(engine.Close)
+	server := faye.NewServerWithOptions(nopLogger{}, engine, allowAll{}, serverOptions)
+	ts := httptest.NewServer(adapters.FayeHandler(server))
+	t.Cleanup(ts.Close)
+	return ts, engine
+}
+
+func newTestClient(t *testing.T, endpoint string, options Options) *Client {
+	c := NewWithOptions(endpoint, options)
+	t.Cleanup(func() { c.Disconnect(context.Background()) })
+	return c
+}
+
+func testContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+func receiveOne(t *testing.T, received <-chan protocol.Message) protocol.Message {
+	t.Helper()
+	select {
+	case msg := <-received:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("no message received")
+		return nil
+	}
+}
+
+func TestPublishSubscribe(t *testing.T) {
+	for _, transport := range []string{protocol.ConnectionTypeWebsocket, protocol.ConnectionTypeLongPolling} {
+		t.Run(transport, func(t *testing.T) {
+			ts, engine := newTestServer(t, faye.EngineOptions{}, faye.ServerOptions{})
+			ctx := testContext(t)
+			options := DefaultOptions
+			options.Transports = []string{transport}
+			subscriber := newTestClient(t, ts.URL, options)
+			publisher := newTestClient(t, ts.URL, options)
+
+			received := make(chan protocol.Message, 10)
+			sub, err := subscriber.Subscribe(ctx, "/chat/*", func(msg protocol.Message) { received <- msg })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := subscriber.Transport(); got != transport {
+				t.Errorf("transport = %q, want %q", got, transport)
+			}
+
+			if err := publisher.Publish(ctx, "/chat/room1", map[string]interface{}{"text": "hi"}); err != nil {
+				t.Fatal(err)
+			}
+			msg := receiveOne(t, received)
+			if data, _ := msg["data"].(map[string]interface{}); msg.Channel().Name() != "/chat/room1" || data["text"] != "hi" {
+				t.Errorf("received %v", msg)
+			}
+
+			if err := sub.Cancel(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if channels := engine.Channels(); len(channels) != 0 {
+				t.Errorf("server subscriptions after cancel = %v", channels)
+			}
+		})
+	}
+}
+
+func TestTransportFallback(t *testing.T) {
+	t.Run("websocket refused", func(t *testing.T) {
+		engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+		t.Cleanup(engine.Close)
+		handler := adapters.FayeHandler(faye.NewServer(nopLogger{}, engine, allowAll{}))
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Upgrade") == "websocket" {
+				http.Error(w, "No websockets", http.StatusForbidden)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}))
+		defer ts.Close()
+
+		c := newTestClient(t, ts.URL, DefaultOptions)
+		if err := c.Handshake(testContext(t)); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Transport(); got != protocol.ConnectionTypeLongPolling {
+			t.Errorf("transport = %q, want long-polling", got)
+		}
+	})
+
+	t.Run("websocket not offered", func(t *testing.T) {
+		ts, _ := newTestServer(t, faye.EngineOptions{
+			ConnectionTypes: []string{protocol.ConnectionTypeLongPolling},
+		}, faye.ServerOptions{})
+		ctx := testContext(t)
+		c := newTestClient(t, ts.URL, DefaultOptions)
+		received := make(chan protocol.Message, 1)
+		if _, err := c.Subscribe(ctx, "/news", func(msg protocol.Message) { received <- msg }); err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Transport(); got != protocol.ConnectionTypeLongPolling {
+			t.Errorf("transport = %q, want long-polling", got)
+		}
+		if err := c.Publish(ctx, "/news", "hi"); err != nil {
+			t.Fatal(err)
+		}
+		receiveOne(t, received)
+	})
+}
+
+func TestRehandshake(t *testing.T) {
+	ts, engine := newTestServer(t, faye.EngineOptions{}, faye.ServerOptions{})
+	ctx := testContext(t)
+	options := DefaultOptions
+	options.RetryInterval = 10 * time.Millisecond
+	c := newTestClient(t, ts.URL, options)
+	received := make(chan protocol.Message, 10)
+	if _, err := c.Subscribe(ctx, "/news", func(msg protocol.Message) { received <- msg }); err != nil {
+		t.Fatal(err)
+	}
+
+	first := c.ClientId()
+	engine.RemoveClient(engine.GetClient(protocol.ParseClientId(first)))
+
+	// The client handshakes again and restores its subscription
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if id := c.ClientId(); id != "" && id != first && engine.Channels()["/news"] == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if engine.Channels()["/news"] != 1 {
+		t.Fatalf("subscription not restored, client %q", c.ClientId())
+	}
+	if err := c.Publish(ctx, "/news", "again"); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receiveOne(t, received); msg["data"] != "again" {
+		t.Errorf("received %v", msg)
+	}
+}
+
+// tokenExtension sends a token with handshakes
+type tokenExtension struct {
+	token string
+}
+
+func (te tokenExtension) Outgoing(msg protocol.Message) protocol.Message {
+	if msg.Channel().MetaType() == protocol.MetaHandshakeChannel {
+		msg["ext"] = map[string]interface{}{"authToken": te.token}
+	}
+	return msg
+}
+
+func (te tokenExtension) Incoming(msg protocol.Message) protocol.Message {
+	return msg
+}
+
+func TestExtensionsAndErrors(t *testing.T) {
+	key := []byte("key")
+	ts, _ := newTestServer(t, faye.EngineOptions{}, faye.ServerOptions{
+		Authenticator: &auth.JWTAuthenticator{Keys: auth.StaticKey(key)},
+		Authorizer:    auth.Rules{{Pattern: "/users/{sub}/**", Subscribe: true, Publish: true}},
+	})
+	ctx := testContext(t)
+
+	anonymous := newTestClient(t, ts.URL, DefaultOptions)
+	var refused *Error
+	if err := anonymous.Handshake(ctx); !errors.As(err, &refused) || refused.Code != 401 {
+		t.Fatalf("handshake without token = %v, want 401", err)
+	}
+	if err := anonymous.Publish(ctx, "/users/42/inbox", "hi"); !errors.As(err, &refused) {
+		t.Errorf("publish after refused handshake = %v", err)
+	}
+
+	token, _ := auth.SignHS256(map[string]interface{}{"sub": "42"}, "", key)
+	options := DefaultOptions
+	options.Extensions = []Extension{tokenExtension{token}}
+	c := newTestClient(t, ts.URL, options)
+	if err := c.Publish(ctx, "/users/42/inbox", "hi"); err != nil {
+		t.Errorf("publish to own channel = %v", err)
+	}
+	err := c.Publish(ctx, "/users/43/inbox", "hi")
+	if !errors.As(err, &refused) || refused.Code != 403 || refused.Message != "Forbidden" {
+		t.Errorf("publish to other user = %v, want 403", err)
+	}
+	if _, err := c.Subscribe(ctx, "/users/43/**", func(protocol.Message) {}); !errors.As(err, &refused) || refused.Code != 403 {
+		t.Errorf("subscribe to other user = %v, want 403", err)
+	}
+
+	if err := c.Disconnect(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Publish(ctx, "/users/42/inbox", "hi"); !errors.Is(err, ErrDisconnected) {
+		t.Errorf("publish after disconnect = %v, want ErrDisconnected", err)
+	}
+}
+
+type refusePublishes struct{}
+
+func (refusePublishes) SubscribeValid(*protocol.Message) bool { return true }
+func (refusePublishes) PublishValid(*protocol.Message) bool   { return false }
+
+func TestRejectedPublish(t *testing.T) {
+	engine := faye.NewEngine(nopLogger{}, time.Hour, make(chan faye.Counters, 1))
+	t.Cleanup(engine.Close)
+	ts := httptest.NewServer(adapters.FayeHandler(faye.NewServer(nopLogger{}, engine, refusePublishes{})))
+	t.Cleanup(ts.Close)
+
+	for _, transport := range []string{protocol.ConnectionTypeWebsocket, protocol.ConnectionTypeLongPolling} {
+		t.Run(transport, func(t *testing.T) {
+			options := DefaultOptions
+			options.Transports = []string{transport}
+			c := newTestClient(t, ts.URL, options)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			var refused *Error
+			if err := c.Publish(ctx, "/news", "hi"); !errors.As(err, &refused) || refused.Message != "Invalid publish" {
+				t.Errorf("refused publish = %v, want Invalid publish", err)
+			}
+		})
+	}
+}
+
+func TestDisconnect(t *testing.T) {
+	for _, transport := range []string{protocol.ConnectionTypeWebsocket, protocol.ConnectionTypeLongPolling} {
+		t.Run(transport, func(t *testing.T) {
+			ts, engine := newTestServer(t, faye.EngineOptions{}, faye.ServerOptions{})
+			ctx := testContext(t)
+			options := DefaultOptions
+			options.Transports = []string{transport}
+			c := newTestClient(t, ts.URL, options)
+			if _, err := c.Subscribe(ctx, "/chat", func(protocol.Message) {}); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := c.Disconnect(ctx); err != nil {
+				t.Fatalf("Disconnect() = %v", err)
+			}
+			if clients := engine.Clients(); len(clients) != 0 {
+				t.Errorf("server still holds %d clients after disconnect", len(clients))
+			}
+			if channels := engine.Channels(); len(channels) != 0 {
+				t.Errorf("server subscriptions after disconnect = %v", channels)
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// ErrTransportClosed is returned for requests whose transport failed before
+// they were answered
+var ErrTransportClosed = errors.New("transport closed")
+
+// transport carries messages to the server and hands the messages it
+// receives to the client
+type transport interface {
+	name() string
+	send(ctx context.Context, msgs []protocol.Message) error
+	// closed is done once the transport failed or was closed
+	closed() <-chan struct{}
+	close()
+}
+
+// openTransport opens the named transport to endpoint, receive is called
+// with every batch of messages from the server
+func (c *Client) openTransport(ctx context.Context, name string, receive func([]protocol.Message)) (transport, error) {
+	switch name {
+	case protocol.ConnectionTypeWebsocket:
+		return dialWebsocket(ctx, c.endpoint, c.options, receive)
+	case protocol.ConnectionTypeLongPolling:
+		return newLongPolling(c.endpoint, c.options, receive), nil
+	}
+	return nil, fmt.Errorf("unsupported connection type %q", name)
+}
+
+type websocketTransport struct {
+	conn      *websocket.Conn
+	mutex     sync.Mutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func websocketURL(endpoint string) string {
+	switch {
+	case strings.HasPrefix(endpoint, "https://"):
+		return "wss://" + strings.TrimPrefix(endpoint, "https://")
+	case strings.HasPrefix(endpoint, "http://"):
+		return "ws://" + strings.TrimPrefix(endpoint, "http://")
+	}
+	return endpoint
+}
+
+func dialWebsocket(ctx context.Context, endpoint string, options Options, receive func([]protocol.Message)) (*websocketTransport, error) {
+	dialer := options.Dialer
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	conn, _, err := dialer.DialContext(ctx, websocketURL(endpoint), options.Header)
+	if err != nil {
+		return nil, err
+	}
+	wt := &websocketTransport{conn: conn, done: make(chan struct{})}
+	go wt.read(receive)
+	return wt, nil
+}
+
+func (wt *websocketTransport) name() string {
+	return protocol.ConnectionTypeWebsocket
+}
+
+func (wt *websocketTransport) read(receive func([]protocol.Message)) {
+	defer wt.close()
+	for {
+		var msgs []protocol.Message
+		if err := wt.conn.ReadJSON(&msgs); err != nil {
+			return
+		}
+		receive(msgs)
+	}
+}
+
+func (wt *websocketTransport) send(ctx context.Context, msgs []protocol.Message) error {
+	wt.mutex.Lock()
+	defer wt.mutex.Unlock()
+	if deadline, ok := ctx.Deadline(); ok {
+		wt.conn.SetWriteDeadline(deadline)
+	}
+	if err := wt.conn.WriteJSON(msgs); err != nil {
+		wt.close()
+		return err
+	}
+	return nil
+}
+
+func (wt *websocketTransport) closed() <-chan struct{} {
+	return wt.done
+}
+
+func (wt *websocketTransport) close() {
+	wt.closeOnce.Do(func() {
+		close(wt.done)
+		wt.conn.Close()
+	})
+}
+
+type longPollingTransport struct {
+	endpoint string
+	client   *http.Client
+	header   http.Header
+	receive  func([]protocol.Message)
+	// Cancelled on close, aborting the requests in flight
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLongPolling(endpoint string, options Options, receive func([]protocol.Message)) *longPollingTransport {
+	client := options.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &longPollingTransport{
+		endpoint: endpoint,
+		client:   client,
+		header:   options.Header,
+		receive:  receive,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+}
+
+func (lp *longPollingTransport) name() string {
+	return protocol.ConnectionTypeLongPolling
+}
+
+// send posts msgs and hands the response to receive before returning
+func (lp *longPollingTransport) send(ctx context.Context, msgs []protocol.Message) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(lp.ctx, cancel)()
+
+	body, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", lp.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range lp.header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := lp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var responses []protocol.Message
+	if err := json.NewDecoder(resp.Body).Decode(&responses); err != nil {
+		return err
+	}
+	lp.receive(responses)
+	return nil
+}
+
+func (lp *longPollingTransport) closed() <-chan struct{} {
+	return lp.ctx.Done()
+}
+
+func (lp *longPollingTransport) close() {
+	lp.cancel()
+}
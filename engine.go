@@ -1,11 +1,16 @@
 package faye
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
+	"slices"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/dsablic/faye-go/jsonschema"
 	"github.com/dsablic/faye-go/memory"
 	"github.com/dsablic/faye-go/protocol"
 	"github.com/dsablic/faye-go/utils"
@@ -17,8 +22,64 @@ type Counters struct {
 	Clients             uint
 	Failed              uint
 	SubscriberByPattern uint
+	DispatchQueueDepth  uint
+	DispatchDropped     uint
+	// Handshakes and subscribes refused by the quotas since the last report
+	RejectedHandshakes    uint
+	RejectedSubscriptions uint
+	// Publishes refused by the payload rules since the last report
+	RejectedPublishes uint
 }
 
+// DefaultConnectionTypes are offered in handshake until a handler offers
+// the transports it serves, see Engine.OfferConnectionTypes
+var DefaultConnectionTypes = []string{protocol.ConnectionTypeWebsocket}
+
+type EngineOptions struct {
+	// Connection types offered in handshake, defaults to DefaultConnectionTypes
+	// and those offered by handlers. When set, handlers can't add to them.
+	ConnectionTypes []string
+	// Tag each delivery with the subscription patterns that matched it
+	TagMatchedSubscriptions bool
+	// Sizes the worker pool delivering published messages, see
+	// memory.DefaultDispatcherOptions for defaults
+	Dispatch memory.DispatcherOptions
+	// Limits on clients and their subscriptions
+	Quotas Quotas
+	// Constraints on the data published to channels, every rule whose
+	// pattern matches the channel applies
+	Payloads []PayloadRule
+	// Builds the messages delivered to subscribers from publishes, defaults
+	// to DefaultSanitizer
+	Sanitizer Sanitizer
+}
+
+// PayloadRule constrains the data published to channels matching Pattern
+type PayloadRule struct {
+	Pattern string
+	// Largest JSON encoding of the data in bytes, zero means no limit
+	MaxSize int
+	// Schema the data must satisfy, nil accepts any data
+	Schema *jsonschema.Schema
+}
+
+// Quotas bound the clients an engine holds, zero disables a limit
+type Quotas struct {
+	// Clients held by the engine
+	MaxClients int
+	// Clients handshaking from the same remote IP
+	MaxClientsPerIP int
+	// Subscriptions held by one client
+	MaxSubscriptionsPerClient int
+	// Wildcard subscriptions, such as /foo/* or /**, held by one client
+	MaxWildcardSubscriptions int
+	// Refuse wildcard subscriptions altogether
+	DenyWildcardSubscriptions bool
+}
+
+// Interval in milliseconds advised to clients refused by a quota
+const quotaRetryInterval = 10000
+
 type Engine struct {
 	statistics      chan Counters
 	clients         *memory.ClientRegister
@@ -26,18 +87,50 @@ type Engine struct {
 	published       uint64
 	reapInterval    time.Duration
 	ticker          *time.Ticker
+	done            chan struct{}
+	closeOnce       sync.Once
 	currentClientID uint32
+	connectionTypes []string
+	fixedTypes      bool
+	typesMutex      sync.RWMutex
+	quotas          Quotas
+	payloads        []PayloadRule
+	sanitizer       Sanitizer
+	// Refusals since the last report, read and reset by reap
+	rejectedHandshakes    uint64
+	rejectedSubscriptions uint64
+	rejectedPublishes     uint64
 }
 
 func NewEngine(logger utils.Logger, reapInterval time.Duration, statistics chan Counters) *Engine {
+	return NewEngineWithOptions(logger, reapInterval, statistics, EngineOptions{})
+}
+
+func NewEngineWithOptions(logger utils.Logger, reapInterval time.Duration, statistics chan Counters, options EngineOptions) *Engine {
 	engine := &Engine{
-		statistics:      statistics,
-		clients:         memory.NewClientRegister(),
+		statistics: statistics,
+		clients: memory.NewClientRegisterWithOptions(memory.ClientRegisterOptions{
+			TagMatchedSubscriptions: options.TagMatchedSubscriptions,
+			Dispatch:                options.Dispatch,
+		}),
 		logger:          logger,
 		published:       0,
 		reapInterval:    reapInterval,
 		ticker:          time.NewTicker(reapInterval),
+		done:            make(chan struct{}),
 		currentClientID: 0,
+		connectionTypes: options.ConnectionTypes,
+		quotas:          options.Quotas,
+		payloads:        options.Payloads,
+		sanitizer:       options.Sanitizer,
+	}
+	if engine.sanitizer == nil {
+		engine.sanitizer = DefaultSanitizer
+	}
+	if len(engine.connectionTypes) == 0 {
+		engine.connectionTypes = DefaultConnectionTypes
+	} else {
+		engine.fixedTypes = true
 	}
 	go engine.reap()
 	return engine
@@ -48,11 +141,44 @@ func (m *Engine) GetClient(clientId uint32) *protocol.Client {
 }
 
 func (m *Engine) NewClient(conn protocol.Connection) *protocol.Client {
+	newClient := m.newClient(conn, nil)
+	m.clients.AddClient(newClient)
+	return newClient
+}
+
+// Clients returns the clients held by the engine ordered by id
+func (m *Engine) Clients() []*protocol.Client {
+	return m.clients.Clients()
+}
+
+// Channels returns the number of clients subscribed to each pattern
+func (m *Engine) Channels() map[string]int {
+	return m.clients.SubscriberCounts()
+}
+
+// RemoveClient disconnects client on the server's initiative, its next
+// request is told to handshake again
+func (m *Engine) RemoveClient(client *protocol.Client) {
+	m.logger.Debugf("Client %d removed", client.Id())
+	m.clients.RemoveClient(client)
+}
+
+// UnsubscribeFrom removes patterns from the subscriptions of client
+func (m *Engine) UnsubscribeFrom(client *protocol.Client, patterns []string) {
+	m.logger.Debugf("UNSUBSCRIBE %d from %v", client.Id(), patterns)
+	client.Unsubscribe(patterns)
+	m.clients.RemoveSubscription(client, patterns)
+}
+
+func (m *Engine) newClient(conn protocol.Connection, principal *protocol.Principal) *protocol.Client {
 	atomic.CompareAndSwapUint32(&m.currentClientID, math.MaxUint32, 0)
 	newClient := protocol.NewClient(
 		atomic.AddUint32(&m.currentClientID, 1),
 		m.logger)
-	m.clients.AddClient(newClient)
+	newClient.SetPeer(protocol.PeerOf(conn))
+	if principal != nil {
+		newClient.SetPrincipal(principal)
+	}
 	return newClient
 }
 
@@ -92,7 +218,7 @@ func (m *Engine) subscriptionResponse(request *protocol.Message) (protocol.Messa
 	return response, subs
 }
 
-func (m *Engine) SubscribeClient(request *protocol.Message, client *protocol.Client) {
+func (m *Engine) SubscribeClient(request *protocol.Message, client *protocol.Client, conn protocol.Connection) {
 	response, subs := m.subscriptionResponse(request)
 	patterns := []string{}
 	for _, s := range subs {
@@ -101,12 +227,63 @@ func (m *Engine) SubscribeClient(request *protocol.Message, client *protocol.Cli
 			patterns = append(patterns, s)
 		}
 	}
+	if refusal := m.checkSubscriptionQuotas(client, patterns); refusal != "" {
+		m.logger.Debugf("SUBSCRIBE %d refused: %s", client.Id(), refusal)
+		atomic.AddUint64(&m.rejectedSubscriptions, 1)
+		conn.Send([]protocol.Message{errorResponse(request, 403, strings.Join(subs, ","), refusal)})
+		return
+	}
 	client.Subscribe(patterns)
 	m.clients.AddSubscription(client, patterns)
-	client.Send(response, request.Jsonp())
+	conn.Send([]protocol.Message{response})
 }
 
-func (m *Engine) UnsubscribeClient(request *protocol.Message, client *protocol.Client) {
+// checkSubscriptionQuotas returns why subscribing client to patterns is
+// refused, or an empty string when it is allowed
+func (m *Engine) checkSubscriptionQuotas(client *protocol.Client, patterns []string) string {
+	q := m.quotas
+	if q.MaxSubscriptionsPerClient == 0 && q.MaxWildcardSubscriptions == 0 && !q.DenyWildcardSubscriptions {
+		return ""
+	}
+
+	added, addedWildcards := 0, 0
+	seen := map[string]struct{}{}
+	for _, pattern := range patterns {
+		if _, ok := seen[pattern]; ok || client.IsSubscribed(pattern) {
+			continue
+		}
+		seen[pattern] = struct{}{}
+		added++
+		if protocol.NewChannel(pattern).IsWildcard() {
+			if q.DenyWildcardSubscriptions {
+				return "Wildcard subscriptions are not allowed"
+			}
+			addedWildcards++
+		}
+	}
+	if added == 0 {
+		return ""
+	}
+
+	existing := client.Subscriptions()
+	if q.MaxSubscriptionsPerClient > 0 && len(existing)+added > q.MaxSubscriptionsPerClient {
+		return "Subscription limit reached"
+	}
+	if q.MaxWildcardSubscriptions > 0 && addedWildcards > 0 {
+		wildcards := addedWildcards
+		for _, pattern := range existing {
+			if protocol.NewChannel(pattern).IsWildcard() {
+				wildcards++
+			}
+		}
+		if wildcards > q.MaxWildcardSubscriptions {
+			return "Wildcard subscription limit reached"
+		}
+	}
+	return ""
+}
+
+func (m *Engine) UnsubscribeClient(request *protocol.Message, client *protocol.Client, conn protocol.Connection) {
 	response, subs := m.subscriptionResponse(request)
 	patterns := []string{}
 	for _, s := range subs {
@@ -117,70 +294,202 @@ func (m *Engine) UnsubscribeClient(request *protocol.Message, client *protocol.C
 	}
 	client.Unsubscribe(patterns)
 	m.clients.RemoveSubscription(client, patterns)
-	client.Send(response, request.Jsonp())
+	conn.Send([]protocol.Message{response})
 }
 
 func (m *Engine) Disconnect(request *protocol.Message, client *protocol.Client, conn protocol.Connection) {
 	response := m.responseFromRequest(request)
 	response["successful"] = true
-	clientId := request.ClientId()
-	m.logger.Debugf("Client %d disconnected", clientId)
-	_ = response
+	m.logger.Debugf("Client %d disconnected", client.Id())
+
+	// A socket may handshake again, so the connection carrying the response
+	// is detached rather than closed along with the client
+	if client.Connection() == conn {
+		client.SetConnection(nil)
+	}
+	m.clients.RemoveClient(client)
+	conn.Send([]protocol.Message{response})
 }
 
 func (m *Engine) Publish(request *protocol.Message, conn protocol.Connection) {
-	response := m.responseFromRequest(request)
-	response["successful"] = true
 	data := (*request)["data"]
 	channel := request.Channel()
-
-	if jsonp := request.Jsonp(); jsonp != "" {
-		conn.SendJsonp([]protocol.Message{response}, jsonp)
-	} else {
-		conn.Send([]protocol.Message{response})
+	if code, refusal := m.checkPayload(channel, data); refusal != "" {
+		m.logger.Debugf("PUBLISH from %d on %s refused: %s", request.ClientId(), channel.Name(), refusal)
+		atomic.AddUint64(&m.rejectedPublishes, 1)
+		conn.Send([]protocol.Message{errorResponse(request, code, channel.Name(), refusal)})
+		return
 	}
 
-	msg := protocol.Message{}
-	msg["channel"] = channel.Name()
-	msg["data"] = data
-	msg.SetClientId(request.ClientId())
+	response := m.responseFromRequest(request)
+	response["successful"] = true
+
+	conn.Send([]protocol.Message{response})
+
+	msg := m.sanitizer.Sanitize(request)
 	m.logger.Debugf("PUBLISH from %d on %s", request.ClientId(), channel)
 	m.clients.Publish(msg)
 	atomic.AddUint64(&m.published, 1)
 }
 
+// checkPayload applies the payload rules matching channel to data, and
+// returns the error code and reason when one of them refuses it
+func (m *Engine) checkPayload(channel protocol.Channel, data interface{}) (int, string) {
+	size := -1
+	for _, rule := range m.payloads {
+		if !channel.Matches(rule.Pattern) {
+			continue
+		}
+		if rule.MaxSize > 0 {
+			if size < 0 {
+				js, err := json.Marshal(data)
+				if err != nil {
+					return 400, "Payload is not valid JSON"
+				}
+				size = len(js)
+			}
+			if size > rule.MaxSize {
+				return 413, fmt.Sprintf("Payload of %d bytes exceeds the limit of %d bytes", size, rule.MaxSize)
+			}
+		}
+		if rule.Schema != nil {
+			if err := rule.Schema.Validate(data); err != nil {
+				return 422, "Payload does not match schema: " + err.Error()
+			}
+		}
+	}
+	return 0, ""
+}
+
 func (m *Engine) Handshake(request *protocol.Message, conn protocol.Connection) uint32 {
+	return m.HandshakeAs(request, conn, nil)
+}
+
+// HandshakeAs is like Handshake for a client authenticated as principal,
+// which is set before the client is registered or told its id
+func (m *Engine) HandshakeAs(request *protocol.Message, conn protocol.Connection, principal *protocol.Principal) uint32 {
 	var newClientId uint32
 
 	version, _ := (*request)["version"].(string)
 
 	response := m.responseFromRequest(request)
 	response["successful"] = false
-	if version == protocol.BayeuxVersion {
-		newClientId = m.NewClient(conn).Id()
+	if version != protocol.BayeuxVersion {
+		response["error"] = fmt.Sprintf("Only supported version is '%s'", protocol.BayeuxVersion)
+	} else if !m.supportsAnyConnectionType(request) {
+		response["supportedConnectionTypes"] = m.ConnectionTypes()
+		response["error"] = fmt.Sprintf("301:%s:Server does not support connection types",
+			strings.Join(requestedConnectionTypes(request), ","))
+	} else if client, refusal := m.addClient(conn, principal); client == nil {
+		m.logger.Debugf("Handshake from %s refused: %s", protocol.PeerOf(conn).RemoteAddr, refusal)
+		atomic.AddUint64(&m.rejectedHandshakes, 1)
+		response = errorResponse(request, 503, "", refusal)
+		response["advice"] = map[string]interface{}{"reconnect": "retry", "interval": quotaRetryInterval}
+	} else {
+		newClientId = client.Id()
 		update := protocol.Message{
 			"channel":                  protocol.MetaPrefix + protocol.MetaHandshakeChannel,
 			"version":                  protocol.BayeuxVersion,
 			"advice":                   protocol.DefaultAdvice,
-			"supportedConnectionTypes": []string{"websocket"},
+			"supportedConnectionTypes": m.ConnectionTypes(),
 			"successful":               true,
 		}
 		update.SetClientId(newClientId)
 		response.Update(update)
-	} else {
-		response["error"] = fmt.Sprintf("Only supported version is '%s'", protocol.BayeuxVersion)
 	}
 
-	if jsonp := request.Jsonp(); jsonp != "" {
-		conn.SendJsonp([]protocol.Message{response}, jsonp)
-	} else {
-		conn.Send([]protocol.Message{response})
-	}
+	conn.Send([]protocol.Message{response})
 	return newClientId
 }
 
+// addClient registers a new client for conn within the client quotas, or
+// returns why it was refused
+func (m *Engine) addClient(conn protocol.Connection, principal *protocol.Principal) (*protocol.Client, string) {
+	client := m.newClient(conn, principal)
+	switch err := m.clients.TryAddClient(client, m.quotas.MaxClients, m.quotas.MaxClientsPerIP); err {
+	case nil:
+		return client, ""
+	case memory.ErrTooManyClients:
+		return nil, "Server is at capacity"
+	default:
+		return nil, "Too many clients from this address"
+	}
+}
+
+func requestedConnectionTypes(request *protocol.Message) []string {
+	var types []string
+	switch v := (*request)["supportedConnectionTypes"].(type) {
+	case []string:
+		types = v
+	case []interface{}:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				types = append(types, s)
+			}
+		}
+	}
+	return types
+}
+
+// A client that does not list its connection types is assumed to speak
+// whatever the server offers
+func (m *Engine) supportsAnyConnectionType(request *protocol.Message) bool {
+	requested := requestedConnectionTypes(request)
+	if len(requested) == 0 {
+		return true
+	}
+	connectionTypes := m.ConnectionTypes()
+	for _, r := range requested {
+		for _, t := range connectionTypes {
+			if r == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ConnectionTypes returns the connection types offered in handshake
+func (m *Engine) ConnectionTypes() []string {
+	m.typesMutex.RLock()
+	defer m.typesMutex.RUnlock()
+	return m.connectionTypes
+}
+
+// OfferConnectionTypes adds connection types served by a handler to those
+// offered in handshake, unless EngineOptions.ConnectionTypes fixed them
+func (m *Engine) OfferConnectionTypes(types ...string) {
+	m.typesMutex.Lock()
+	defer m.typesMutex.Unlock()
+	if m.fixedTypes {
+		return
+	}
+	offered := append([]string(nil), m.connectionTypes...)
+	for _, t := range types {
+		if !slices.Contains(offered, t) {
+			offered = append(offered, t)
+		}
+	}
+	m.connectionTypes = offered
+}
+
+// Close stops reaping clients and delivering published messages. Clients
+// are left as they are, the engine is not meant to be used afterwards.
+func (m *Engine) Close() {
+	m.closeOnce.Do(func() {
+		m.ticker.Stop()
+		close(m.done)
+		m.clients.Close()
+	})
+}
+
 func (m *Engine) reap() {
-	for range m.ticker.C {
+	for {
+		select {
+		case <-m.ticker.C:
+		case <-m.done:
+			return
+		}
 		registerCounters := m.clients.Reap()
 		c := Counters{}
 		c.Clients = registerCounters.Clients
@@ -188,6 +497,11 @@ func (m *Engine) reap() {
 		c.Sent = uint(registerCounters.TotalSent)
 		c.Published = uint(atomic.SwapUint64(&m.published, 0))
 		c.SubscriberByPattern = uint(registerCounters.SubscriberByPatternCount)
+		c.DispatchQueueDepth = uint(registerCounters.DispatchQueueDepth)
+		c.DispatchDropped = uint(registerCounters.DispatchDropped)
+		c.RejectedHandshakes = uint(atomic.SwapUint64(&m.rejectedHandshakes, 0))
+		c.RejectedSubscriptions = uint(atomic.SwapUint64(&m.rejectedSubscriptions, 0))
+		c.RejectedPublishes = uint(atomic.SwapUint64(&m.rejectedPublishes, 0))
 		select {
 		case m.statistics <- c:
 		default:
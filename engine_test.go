@@ -0,0 +1,370 @@
+package faye
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/jsonschema"
+	"github.com/dsablic/faye-go/protocol"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Panicf(string, ...interface{}) {}
+
+type recordingConnection struct {
+	mutex      sync.Mutex
+	received   []protocol.Message
+	closed     bool
+	singleShot bool
+	peer       protocol.PeerInfo
+}
+
+func (rc *recordingConnection) Send(msgs []protocol.Message) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.received = append(rc.received, msgs...)
+	return nil
+}
+
+func (rc *recordingConnection) IsConnected() bool {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return !rc.closed
+}
+
+func (rc *recordingConnection) IsSingleShot() bool { return rc.singleShot }
+
+func (rc *recordingConnection) Peer() protocol.PeerInfo { return rc.peer }
+
+func (rc *recordingConnection) Close() {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.closed = true
+}
+
+func (rc *recordingConnection) messages() []protocol.Message {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return append([]protocol.Message(nil), rc.received...)
+}
+
+func (rc *recordingConnection) last(t *testing.T) protocol.Message {
+	t.Helper()
+	msgs := rc.messages()
+	if len(msgs) == 0 {
+		t.Fatalf("no message received")
+	}
+	return msgs[len(msgs)-1]
+}
+
+func newTestEngine(t *testing.T, options EngineOptions) *Engine {
+	engine := NewEngineWithOptions(nopLogger{}, time.Hour, make(chan Counters, 1), options)
+	t.Cleanup(engine.Close)
+	return engine
+}
+
+func TestHandshakeNegotiatesConnectionTypes(t *testing.T) {
+	tests := []struct {
+		name       string
+		requested  interface{}
+		successful bool
+	}{
+		{"no types listed", nil, true},
+		{"websocket", []interface{}{"websocket"}, true},
+		{"one of several", []interface{}{"long-polling", "websocket"}, true},
+		{"not offered by default", []interface{}{"long-polling"}, false},
+		{"unsupported", []interface{}{"flash"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newTestEngine(t, EngineOptions{})
+			conn := &recordingConnection{}
+			request := protocol.Message{
+				"channel": "/meta/handshake",
+				"version": protocol.BayeuxVersion,
+			}
+			if tt.requested != nil {
+				request["supportedConnectionTypes"] = tt.requested
+			}
+
+			engine.Handshake(&request, conn)
+
+			response := conn.last(t)
+			if response["successful"] != tt.successful {
+				t.Errorf("successful = %v, want %v (%v)", response["successful"], tt.successful, response)
+			}
+			if !reflect.DeepEqual(response["supportedConnectionTypes"], DefaultConnectionTypes) {
+				t.Errorf("supportedConnectionTypes = %v, want %v", response["supportedConnectionTypes"], DefaultConnectionTypes)
+			}
+		})
+	}
+}
+
+func TestOfferConnectionTypes(t *testing.T) {
+	handshake := func(engine *Engine) protocol.Message {
+		conn := &recordingConnection{}
+		engine.Handshake(&protocol.Message{
+			"channel":                  "/meta/handshake",
+			"version":                  protocol.BayeuxVersion,
+			"supportedConnectionTypes": []interface{}{"long-polling"},
+		}, conn)
+		return conn.last(t)
+	}
+
+	engine := newTestEngine(t, EngineOptions{})
+	engine.OfferConnectionTypes(protocol.ConnectionTypeLongPolling, protocol.ConnectionTypeWebsocket)
+	response := handshake(engine)
+	if response["successful"] != true {
+		t.Errorf("handshake refused after long-polling was offered: %v", response)
+	}
+	want := []string{protocol.ConnectionTypeWebsocket, protocol.ConnectionTypeLongPolling}
+	if !reflect.DeepEqual(response["supportedConnectionTypes"], want) {
+		t.Errorf("supportedConnectionTypes = %v, want %v", response["supportedConnectionTypes"], want)
+	}
+
+	fixed := newTestEngine(t, EngineOptions{ConnectionTypes: []string{protocol.ConnectionTypeWebsocket}})
+	fixed.OfferConnectionTypes(protocol.ConnectionTypeLongPolling)
+	if response := handshake(fixed); response["successful"] != false {
+		t.Errorf("handshake accepted long-polling the options left out: %v", response)
+	}
+}
+
+func handshakeFrom(t *testing.T, engine *Engine, addr string) protocol.Message {
+	t.Helper()
+	conn := &recordingConnection{peer: protocol.PeerInfo{RemoteAddr: addr}}
+	engine.Handshake(&protocol.Message{"channel": "/meta/handshake", "version": protocol.BayeuxVersion}, conn)
+	return conn.last(t)
+}
+
+func TestHandshakeQuotas(t *testing.T) {
+	engine := newTestEngine(t, EngineOptions{Quotas: Quotas{MaxClients: 3, MaxClientsPerIP: 2}})
+
+	for _, addr := range []string{"10.0.0.1", "10.0.0.1"} {
+		if response := handshakeFrom(t, engine, addr); response["successful"] != true {
+			t.Fatalf("handshake within quota = %v", response)
+		}
+	}
+	response := handshakeFrom(t, engine, "10.0.0.1")
+	if response["successful"] != false || response["error"] != "503::Too many clients from this address" {
+		t.Errorf("third handshake from one address = %v", response)
+	}
+	if advice, _ := response["advice"].(map[string]interface{}); advice["reconnect"] != "retry" {
+		t.Errorf("advice = %v, want retry", advice)
+	}
+
+	if response := handshakeFrom(t, engine, "10.0.0.2"); response["successful"] != true {
+		t.Fatalf("handshake from another address = %v", response)
+	}
+	if response := handshakeFrom(t, engine, "10.0.0.3"); response["error"] != "503::Server is at capacity" {
+		t.Errorf("handshake past MaxClients = %v", response)
+	}
+	if got := atomic.LoadUint64(&engine.rejectedHandshakes); got != 2 {
+		t.Errorf("rejected handshakes = %d, want 2", got)
+	}
+}
+
+// principalConnection records the principal of the handshaking client as
+// the response is sent
+type principalConnection struct {
+	recordingConnection
+	engine *Engine
+	seen   *protocol.Principal
+}
+
+func (pc *principalConnection) Send(msgs []protocol.Message) error {
+	for _, msg := range msgs {
+		if clientId, ok := msg["clientId"].(string); ok {
+			pc.seen = pc.engine.GetClient(protocol.ParseClientId(clientId)).Principal()
+		}
+	}
+	return pc.recordingConnection.Send(msgs)
+}
+
+func TestHandshakeAsSetsPrincipalFirst(t *testing.T) {
+	engine := newTestEngine(t, EngineOptions{})
+	conn := &principalConnection{engine: engine}
+	principal := &protocol.Principal{Subject: "42"}
+
+	engine.HandshakeAs(&protocol.Message{"channel": "/meta/handshake", "version": protocol.BayeuxVersion}, conn, principal)
+	if conn.seen != principal {
+		t.Errorf("principal when the response was sent = %v, want %v", conn.seen, principal)
+	}
+}
+
+func TestDisconnectFreesQuota(t *testing.T) {
+	engine := newTestEngine(t, EngineOptions{Quotas: Quotas{MaxClients: 1, MaxClientsPerIP: 1}})
+	conn := &recordingConnection{peer: protocol.PeerInfo{RemoteAddr: "10.0.0.1"}}
+
+	engine.Handshake(&protocol.Message{"channel": "/meta/handshake", "version": protocol.BayeuxVersion}, conn)
+	clientId := conn.last(t)["clientId"]
+	client := engine.GetClient(protocol.ParseClientId(clientId.(string)))
+	client.SetConnection(conn)
+
+	engine.Disconnect(&protocol.Message{"channel": "/meta/disconnect", "clientId": clientId, "id": "2"}, client, conn)
+	response := conn.last(t)
+	if response["successful"] != true || response["id"] != "2" {
+		t.Errorf("disconnect response = %v", response)
+	}
+	if engine.GetClient(client.Id()) != nil {
+		t.Errorf("client still registered after disconnect")
+	}
+	if !conn.IsConnected() {
+		t.Errorf("connection carrying the disconnect response was closed")
+	}
+
+	engine.Handshake(&protocol.Message{"channel": "/meta/handshake", "version": protocol.BayeuxVersion}, conn)
+	if response := conn.last(t); response["successful"] != true {
+		t.Errorf("handshake after disconnect = %v", response)
+	}
+}
+
+func TestSubscriptionQuotas(t *testing.T) {
+	tests := []struct {
+		name     string
+		quotas   Quotas
+		existing []string
+		request  interface{}
+		refusal  string
+	}{
+		{"within limit", Quotas{MaxSubscriptionsPerClient: 2}, []string{"/a"}, "/b", ""},
+		{"over limit", Quotas{MaxSubscriptionsPerClient: 2}, []string{"/a", "/b"}, "/c", "Subscription limit reached"},
+		{"resubscribing is free", Quotas{MaxSubscriptionsPerClient: 2}, []string{"/a", "/b"}, "/a", ""},
+		{"batch over limit", Quotas{MaxSubscriptionsPerClient: 2}, []string{"/a"}, []interface{}{"/b", "/c"}, "Subscription limit reached"},
+		{"wildcards denied", Quotas{DenyWildcardSubscriptions: true}, nil, "/foo/**", "Wildcard subscriptions are not allowed"},
+		{"plain channel with wildcards denied", Quotas{DenyWildcardSubscriptions: true}, nil, "/foo", ""},
+		{"wildcard within limit", Quotas{MaxWildcardSubscriptions: 2}, []string{"/a/*", "/b"}, "/c/**", ""},
+		{"wildcard over limit", Quotas{MaxWildcardSubscriptions: 1}, []string{"/a/*"}, "/**", "Wildcard subscription limit reached"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newTestEngine(t, EngineOptions{Quotas: tt.quotas})
+			conn := &recordingConnection{}
+			client := engine.NewClient(conn)
+			client.Subscribe(tt.existing)
+
+			request := protocol.Message{"channel": "/meta/subscribe", "subscription": tt.request, "id": "1"}
+			engine.SubscribeClient(&request, client, conn)
+
+			response := conn.last(t)
+			if tt.refusal == "" {
+				if response["successful"] != true {
+					t.Errorf("subscribe = %v, want success", response)
+				}
+				return
+			}
+			if response["successful"] != false || response["id"] != "1" {
+				t.Errorf("subscribe = %v, want refusal", response)
+			}
+			if err, _ := response["error"].(string); !strings.HasPrefix(err, "403:") || !strings.HasSuffix(err, ":"+tt.refusal) {
+				t.Errorf("error = %q, want 403 %q", err, tt.refusal)
+			}
+			if got := len(client.Subscriptions()); got != len(tt.existing) {
+				t.Errorf("client holds %d subscriptions after refusal, want %d", got, len(tt.existing))
+			}
+		})
+	}
+}
+
+func TestPublishPayloadRules(t *testing.T) {
+	engine := newTestEngine(t, EngineOptions{Payloads: []PayloadRule{
+		{Pattern: "/**", MaxSize: 64},
+		{Pattern: "/chat/*", Schema: jsonschema.MustCompile(`{"type": "object", "required": ["text"]}`)},
+	}})
+
+	tests := []struct {
+		name    string
+		channel string
+		data    interface{}
+		error   string
+	}{
+		{"within limits", "/chat/room1", map[string]interface{}{"text": "hi"}, ""},
+		{"other channel skips schema", "/news", "hi", ""},
+		{"too large", "/news", strings.Repeat("x", 100), "413:/news:Payload of 102 bytes exceeds the limit of 64 bytes"},
+		{"schema mismatch", "/chat/room1", map[string]interface{}{"body": "hi"}, `422:/chat/room1:Payload does not match schema: missing required property "text"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn := &recordingConnection{}
+			engine.Publish(&protocol.Message{"channel": tt.channel, "data": tt.data, "id": "7"}, conn)
+
+			response := conn.last(t)
+			if tt.error == "" {
+				if response["successful"] != true {
+					t.Errorf("publish = %v, want success", response)
+				}
+				return
+			}
+			if response["successful"] != false || response["error"] != tt.error || response["id"] != "7" {
+				t.Errorf("publish = %v, want error %q", response, tt.error)
+			}
+		})
+	}
+	if got := atomic.LoadUint64(&engine.rejectedPublishes); got != 2 {
+		t.Errorf("rejected publishes = %d, want 2", got)
+	}
+}
+
+func TestPublishSanitizer(t *testing.T) {
+	publish := protocol.Message{
+		"channel":  "/chat",
+		"data":     "hi",
+		"id":       "42",
+		"clientId": "client-7",
+		"ext":      map[string]interface{}{"token": "abc"},
+	}
+
+	tests := []struct {
+		name      string
+		sanitizer Sanitizer
+		want      protocol.Message
+	}{
+		{"default", nil, protocol.Message{"channel": "/chat", "data": "hi", "id": "42"}},
+		{"nothing forwarded", ForwardFields{}, protocol.Message{"channel": "/chat", "data": "hi"}},
+		{"everything forwarded", ForwardFields{ClientId: true, Ext: true, Id: true}, publish},
+		{"custom", SanitizerFunc(func(p *protocol.Message) protocol.Message {
+			return protocol.Message{"channel": p.Channel().Name(), "data": "redacted"}
+		}), protocol.Message{"channel": "/chat", "data": "redacted"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			engine := newTestEngine(t, EngineOptions{Sanitizer: tt.sanitizer})
+			subscriber := &recordingConnection{}
+			client := engine.NewClient(subscriber)
+			client.SetConnection(subscriber)
+			subscribe := protocol.Message{"channel": "/meta/subscribe", "subscription": "/chat"}
+			engine.SubscribeClient(&subscribe, client, &recordingConnection{})
+
+			request := protocol.Message{}
+			for k, v := range publish {
+				request[k] = v
+			}
+			engine.Publish(&request, &recordingConnection{})
+
+			deadline := time.Now().Add(time.Second)
+			for len(subscriber.messages()) == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			delivered := subscriber.messages()
+			if len(delivered) != 1 {
+				t.Fatalf("delivered %v, want one message", delivered)
+			}
+			if !reflect.DeepEqual(delivered[0], tt.want) {
+				t.Errorf("delivered %v, want %v", delivered[0], tt.want)
+			}
+		})
+	}
+}
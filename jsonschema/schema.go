@@ -0,0 +1,527 @@
+// Package jsonschema validates decoded JSON against a subset of JSON Schema
+// (draft 2020-12): type, enum, const, numeric and length bounds, pattern,
+// properties, required, additionalProperties, items, uniqueItems and the
+// allOf/anyOf/oneOf/not combinators. Annotations such as title and
+// description are accepted, any other keyword, references and format
+// included, fails to compile rather than being ignored.
+package jsonschema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+type Schema struct {
+	// Boolean schemas accept or reject everything
+	always *bool
+
+	types                []string
+	enum                 []interface{}
+	constant             interface{}
+	hasConst             bool
+	minimum              *float64
+	maximum              *float64
+	exclusiveMinimum     *float64
+	exclusiveMaximum     *float64
+	multipleOf           *float64
+	minLength            *int
+	maxLength            *int
+	pattern              *regexp.Regexp
+	properties           map[string]*Schema
+	required             []string
+	additionalProperties *Schema
+	minProperties        *int
+	maxProperties        *int
+	items                *Schema
+	minItems             *int
+	maxItems             *int
+	uniqueItems          bool
+	allOf                []*Schema
+	anyOf                []*Schema
+	oneOf                []*Schema
+	not                  *Schema
+}
+
+// ValidationError locates the first value that does not satisfy the schema
+type ValidationError struct {
+	// JSON pointer to the offending value, empty for the root
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return e.Message
+	}
+	return e.Path + ": " + e.Message
+}
+
+// Compile parses a JSON encoded schema
+func Compile(data []byte) (*Schema, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return nil, err
+	}
+	return compile(v, "")
+}
+
+// MustCompile is like Compile but panics on an invalid schema
+func MustCompile(data string) *Schema {
+	s, err := Compile([]byte(data))
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// knownKeywords are validated by compiled schemas, or are annotations
+// that don't affect validation
+var knownKeywords = map[string]bool{
+	"type": true, "enum": true, "const": true,
+	"minimum": true, "maximum": true, "exclusiveMinimum": true, "exclusiveMaximum": true, "multipleOf": true,
+	"minLength": true, "maxLength": true, "pattern": true,
+	"properties": true, "required": true, "additionalProperties": true, "minProperties": true, "maxProperties": true,
+	"items": true, "minItems": true, "maxItems": true, "uniqueItems": true,
+	"allOf": true, "anyOf": true, "oneOf": true, "not": true,
+
+	"$schema": true, "$id": true, "$comment": true, "title": true, "description": true,
+	"default": true, "examples": true, "deprecated": true, "readOnly": true, "writeOnly": true,
+}
+
+// isMultiple reports whether value is a multiple of divisor. Decimal
+// divisors have no exact binary form, 0.3 / 0.1 is 2.9999999999999996, so
+// the quotient only has to be within a relative tolerance of an integer.
+func isMultiple(value, divisor float64) bool {
+	q := value / divisor
+	if math.IsInf(q, 0) || math.IsNaN(q) {
+		return false
+	}
+	return math.Abs(q-math.Round(q)) <= 1e-9*math.Max(1, math.Abs(q))
+}
+
+var validTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "string": true, "integer": true,
+}
+
+func compile(v interface{}, path string) (*Schema, error) {
+	if b, ok := v.(bool); ok {
+		return &Schema{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("schema%s: must be an object or boolean", path)
+	}
+
+	s := &Schema{}
+	var err error
+	fail := func(keyword, format string, args ...interface{}) error {
+		return fmt.Errorf("schema%s/%s: %s", path, keyword, fmt.Sprintf(format, args...))
+	}
+	number := func(keyword string) (*float64, error) {
+		raw, ok := m[keyword]
+		if !ok {
+			return nil, nil
+		}
+		f, ok := raw.(float64)
+		if !ok {
+			return nil, fail(keyword, "must be a number")
+		}
+		return &f, nil
+	}
+	count := func(keyword string) (*int, error) {
+		f, err := number(keyword)
+		if err != nil || f == nil {
+			return nil, err
+		}
+		if *f < 0 || *f != math.Trunc(*f) {
+			return nil, fail(keyword, "must be a non-negative integer")
+		}
+		n := int(*f)
+		return &n, nil
+	}
+	subschemas := func(keyword string) ([]*Schema, error) {
+		raw, ok := m[keyword]
+		if !ok {
+			return nil, nil
+		}
+		list, ok := raw.([]interface{})
+		if !ok || len(list) == 0 {
+			return nil, fail(keyword, "must be a non-empty array")
+		}
+		schemas := make([]*Schema, len(list))
+		for i, item := range list {
+			if schemas[i], err = compile(item, fmt.Sprintf("%s/%s/%d", path, keyword, i)); err != nil {
+				return nil, err
+			}
+		}
+		return schemas, nil
+	}
+
+	for keyword := range m {
+		if !knownKeywords[keyword] {
+			return nil, fail(keyword, "not supported")
+		}
+	}
+
+	switch t := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{t}
+	case []interface{}:
+		for _, item := range t {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fail("type", "must be a string or array of strings")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, fail("type", "must be a string or array of strings")
+	}
+	for _, t := range s.types {
+		if !validTypes[t] {
+			return nil, fail("type", "unknown type %q", t)
+		}
+	}
+
+	if raw, ok := m["enum"]; ok {
+		if s.enum, ok = raw.([]interface{}); !ok {
+			return nil, fail("enum", "must be an array")
+		}
+	}
+	s.constant, s.hasConst = m["const"]
+
+	if s.minimum, err = number("minimum"); err != nil {
+		return nil, err
+	}
+	if s.maximum, err = number("maximum"); err != nil {
+		return nil, err
+	}
+	if s.exclusiveMinimum, err = number("exclusiveMinimum"); err != nil {
+		return nil, err
+	}
+	if s.exclusiveMaximum, err = number("exclusiveMaximum"); err != nil {
+		return nil, err
+	}
+	if s.multipleOf, err = number("multipleOf"); err != nil {
+		return nil, err
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, fail("multipleOf", "must be greater than 0")
+	}
+	if s.minLength, err = count("minLength"); err != nil {
+		return nil, err
+	}
+	if s.maxLength, err = count("maxLength"); err != nil {
+		return nil, err
+	}
+	if s.minProperties, err = count("minProperties"); err != nil {
+		return nil, err
+	}
+	if s.maxProperties, err = count("maxProperties"); err != nil {
+		return nil, err
+	}
+	if s.minItems, err = count("minItems"); err != nil {
+		return nil, err
+	}
+	if s.maxItems, err = count("maxItems"); err != nil {
+		return nil, err
+	}
+
+	if raw, ok := m["pattern"]; ok {
+		p, ok := raw.(string)
+		if !ok {
+			return nil, fail("pattern", "must be a string")
+		}
+		if s.pattern, err = regexp.Compile(p); err != nil {
+			return nil, fail("pattern", "%v", err)
+		}
+	}
+
+	if raw, ok := m["properties"]; ok {
+		props, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fail("properties", "must be an object")
+		}
+		s.properties = make(map[string]*Schema, len(props))
+		for name, prop := range props {
+			if s.properties[name], err = compile(prop, path+"/properties/"+name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if raw, ok := m["required"]; ok {
+		list, ok := raw.([]interface{})
+		if !ok {
+			return nil, fail("required", "must be an array of strings")
+		}
+		for _, item := range list {
+			name, ok := item.(string)
+			if !ok {
+				return nil, fail("required", "must be an array of strings")
+			}
+			s.required = append(s.required, name)
+		}
+	}
+	if raw, ok := m["additionalProperties"]; ok {
+		if s.additionalProperties, err = compile(raw, path+"/additionalProperties"); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := m["items"]; ok {
+		if s.items, err = compile(raw, path+"/items"); err != nil {
+			return nil, err
+		}
+	}
+	if raw, ok := m["uniqueItems"]; ok {
+		if s.uniqueItems, ok = raw.(bool); !ok {
+			return nil, fail("uniqueItems", "must be a boolean")
+		}
+	}
+
+	if s.allOf, err = subschemas("allOf"); err != nil {
+		return nil, err
+	}
+	if s.anyOf, err = subschemas("anyOf"); err != nil {
+		return nil, err
+	}
+	if s.oneOf, err = subschemas("oneOf"); err != nil {
+		return nil, err
+	}
+	if raw, ok := m["not"]; ok {
+		if s.not, err = compile(raw, path+"/not"); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Validate checks a value decoded by encoding/json against the schema
+func (s *Schema) Validate(v interface{}) error {
+	if err := s.validate(v, ""); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Schema) validate(v interface{}, path string) *ValidationError {
+	fail := func(format string, args ...interface{}) *ValidationError {
+		return &ValidationError{Path: path, Message: fmt.Sprintf(format, args...)}
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			return fail("no value is allowed")
+		}
+		return nil
+	}
+
+	if len(s.types) > 0 && !s.hasType(v) {
+		return fail("expected %s, got %s", strings.Join(s.types, " or "), typeOf(v))
+	}
+	if s.enum != nil {
+		found := false
+		for _, allowed := range s.enum {
+			if equal(v, allowed) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !equal(v, s.constant) {
+		return fail("value does not match the constant")
+	}
+
+	switch value := v.(type) {
+	case float64:
+		if err := s.validateNumber(value, fail); err != nil {
+			return err
+		}
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.minLength != nil && length < *s.minLength {
+			return fail("shorter than %d characters", *s.minLength)
+		}
+		if s.maxLength != nil && length > *s.maxLength {
+			return fail("longer than %d characters", *s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			return fail("does not match pattern %q", s.pattern.String())
+		}
+	case map[string]interface{}:
+		if err := s.validateObject(value, path, fail); err != nil {
+			return err
+		}
+	case []interface{}:
+		if err := s.validateArray(value, path, fail); err != nil {
+			return err
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if s.anyOf != nil {
+		matched := false
+		for _, sub := range s.anyOf {
+			if sub.validate(v, path) == nil {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fail("does not match any of the allowed schemas")
+		}
+	}
+	if s.oneOf != nil {
+		matches := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail("matches %d of the schemas, want exactly one", matches)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return fail("matches a disallowed schema")
+	}
+	return nil
+}
+
+func (s *Schema) validateNumber(value float64, fail func(string, ...interface{}) *ValidationError) *ValidationError {
+	if s.minimum != nil && value < *s.minimum {
+		return fail("less than minimum %v", *s.minimum)
+	}
+	if s.maximum != nil && value > *s.maximum {
+		return fail("greater than maximum %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && value <= *s.exclusiveMinimum {
+		return fail("not greater than %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && value >= *s.exclusiveMaximum {
+		return fail("not less than %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		if !isMultiple(value, *s.multipleOf) {
+			return fail("not a multiple of %v", *s.multipleOf)
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateObject(value map[string]interface{}, path string, fail func(string, ...interface{}) *ValidationError) *ValidationError {
+	if s.minProperties != nil && len(value) < *s.minProperties {
+		return fail("fewer than %d properties", *s.minProperties)
+	}
+	if s.maxProperties != nil && len(value) > *s.maxProperties {
+		return fail("more than %d properties", *s.maxProperties)
+	}
+	for _, name := range s.required {
+		if _, ok := value[name]; !ok {
+			return fail("missing required property %q", name)
+		}
+	}
+
+	// Properties are checked in order so the reported error is stable
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub, ok := s.properties[name]
+		if !ok {
+			sub = s.additionalProperties
+		}
+		if sub == nil {
+			continue
+		}
+		if sub.always != nil && !*sub.always && !ok {
+			return fail("property %q is not allowed", name)
+		}
+		if err := sub.validate(value[name], path+"/"+escapePointer(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Schema) validateArray(value []interface{}, path string, fail func(string, ...interface{}) *ValidationError) *ValidationError {
+	if s.minItems != nil && len(value) < *s.minItems {
+		return fail("fewer than %d items", *s.minItems)
+	}
+	if s.maxItems != nil && len(value) > *s.maxItems {
+		return fail("more than %d items", *s.maxItems)
+	}
+	if s.uniqueItems {
+		for i := range value {
+			for j := 0; j < i; j++ {
+				if equal(value[i], value[j]) {
+					return fail("items %d and %d are equal", j, i)
+				}
+			}
+		}
+	}
+	if s.items != nil {
+		for i, item := range value {
+			if err := s.items.validate(item, fmt.Sprintf("%s/%d", path, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (s *Schema) hasType(v interface{}) bool {
+	actual := typeOf(v)
+	for _, t := range s.types {
+		if t == actual || (t == "number" && actual == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func typeOf(v interface{}) string {
+	switch value := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		if value == math.Trunc(value) && !math.IsInf(value, 0) {
+			return "integer"
+		}
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", v)
+	}
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+func escapePointer(name string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(name)
+}
@@ -0,0 +1,137 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	schema := MustCompile(`{
+		"type": "object",
+		"required": ["user", "text"],
+		"additionalProperties": false,
+		"properties": {
+			"user": {"type": "integer", "minimum": 1},
+			"text": {"type": "string", "minLength": 1, "maxLength": 5},
+			"kind": {"enum": ["chat", "notice"]},
+			"tags": {"type": "array", "items": {"type": "string", "pattern": "^[a-z]+$"}, "maxItems": 2, "uniqueItems": true},
+			"score": {"type": ["number", "null"], "exclusiveMaximum": 10, "multipleOf": 0.5},
+			"ref": {"oneOf": [{"type": "string"}, {"type": "integer"}]},
+			"meta": {"not": {"type": "array"}}
+		}
+	}`)
+
+	tests := []struct {
+		name  string
+		data  string
+		error string
+	}{
+		{"valid", `{"user": 1, "text": "hi"}`, ""},
+		{"all properties", `{"user": 1, "text": "hi", "kind": "chat", "tags": ["a", "b"], "score": 9.5, "ref": 3, "meta": {}}`, ""},
+		{"null allowed", `{"user": 1, "text": "hi", "score": null}`, ""},
+		{"wrong root type", `"hello"`, "expected object, got string"},
+		{"missing required", `{"user": 1}`, `missing required property "text"`},
+		{"additional property", `{"user": 1, "text": "hi", "extra": true}`, `property "extra" is not allowed`},
+		{"integer", `{"user": 1.5, "text": "hi"}`, "/user: expected integer, got number"},
+		{"minimum", `{"user": 0, "text": "hi"}`, "/user: less than minimum 1"},
+		{"max length", `{"user": 1, "text": "héllo!"}`, "/text: longer than 5 characters"},
+		{"enum", `{"user": 1, "text": "hi", "kind": "other"}`, "/kind: value is not one of the allowed values"},
+		{"item pattern", `{"user": 1, "text": "hi", "tags": ["a", "B"]}`, `/tags/1: does not match pattern "^[a-z]+$"`},
+		{"unique items", `{"user": 1, "text": "hi", "tags": ["a", "a"]}`, "/tags: items 0 and 1 are equal"},
+		{"max items", `{"user": 1, "text": "hi", "tags": ["a", "b", "c"]}`, "/tags: more than 2 items"},
+		{"exclusive maximum", `{"user": 1, "text": "hi", "score": 10}`, "/score: not less than 10"},
+		{"multiple of", `{"user": 1, "text": "hi", "score": 1.2}`, "/score: not a multiple of 0.5"},
+		{"one of", `{"user": 1, "text": "hi", "ref": true}`, "/ref: matches 0 of the schemas, want exactly one"},
+		{"not", `{"user": 1, "text": "hi", "meta": []}`, "/meta: matches a disallowed schema"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data interface{}
+			if err := json.Unmarshal([]byte(tt.data), &data); err != nil {
+				t.Fatal(err)
+			}
+			err := schema.Validate(data)
+			if tt.error == "" {
+				if err != nil {
+					t.Errorf("Validate() = %v, want nil", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.error {
+				t.Errorf("Validate() = %v, want %q", err, tt.error)
+			}
+		})
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+	}{
+		{"not json", `{`},
+		{"not an object", `[]`},
+		{"unknown type", `{"type": "date"}`},
+		{"bad pattern", `{"pattern": "("}`},
+		{"negative length", `{"minLength": -1}`},
+		{"unsupported ref", `{"properties": {"a": {"$ref": "#/defs/a"}}}`},
+		{"unsupported format", `{"type": "string", "format": "email"}`},
+		{"unsupported nested keyword", `{"items": {"contains": {"const": 1}}}`},
+		{"misspelled keyword", `{"type": "string", "maxlength": 3}`},
+		{"empty anyOf", `{"anyOf": []}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Compile([]byte(tt.schema)); err == nil {
+				t.Errorf("Compile(%s) succeeded, want error", tt.schema)
+			}
+		})
+	}
+}
+
+func TestBooleanSchemas(t *testing.T) {
+	if err := MustCompile(`true`).Validate("anything"); err != nil {
+		t.Errorf("true schema rejected a value: %v", err)
+	}
+	if err := MustCompile(`false`).Validate("anything"); err == nil {
+		t.Errorf("false schema accepted a value")
+	}
+}
+
+func TestCompileAcceptsAnnotations(t *testing.T) {
+	schema := `{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title": "Message",
+		"description": "A chat message",
+		"type": "object",
+		"properties": {"text": {"type": "string", "default": "", "examples": ["hi"]}}
+	}`
+	if _, err := Compile([]byte(schema)); err != nil {
+		t.Errorf("Compile() = %v", err)
+	}
+}
+
+func TestMultipleOfDecimals(t *testing.T) {
+	tests := []struct {
+		divisor string
+		value   float64
+		valid   bool
+	}{
+		{"0.1", 0.3, true},
+		{"0.1", 1.7, true},
+		{"0.01", 19.99, true},
+		{"0.1", 0.35, false},
+		{"0.5", 2.5, true},
+		{"0.5", 2.6, false},
+		{"3", 9, true},
+		{"3", 10, false},
+	}
+	for _, tt := range tests {
+		s := MustCompile(`{"multipleOf": ` + tt.divisor + `}`)
+		if err := s.Validate(tt.value); (err == nil) != tt.valid {
+			t.Errorf("%v multipleOf %s: Validate() = %v, want valid %v", tt.value, tt.divisor, err, tt.valid)
+		}
+	}
+}
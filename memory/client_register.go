@@ -1,6 +1,9 @@
 package memory
 
 import (
+	"errors"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/dsablic/faye-go/protocol"
@@ -11,30 +14,107 @@ type ClientRegisterCounters struct {
 	TotalSent                uint64
 	Clients                  uint
 	SubscriberByPatternCount uint64
+	DispatchQueueDepth       int64
+	DispatchDropped          uint64
 }
 
+type ClientRegisterOptions struct {
+	// Adds the subscription patterns that matched a published message to
+	// each delivery so clients can route it without matching again.
+	TagMatchedSubscriptions bool
+	// Number of lock stripes in the subscription register, defaults to
+	// DefaultSubscriptionShards
+	SubscriptionShards int
+	Dispatch           DispatcherOptions
+}
+
+var (
+	ErrTooManyClients         = errors.New("too many clients")
+	ErrTooManyClientsFromAddr = errors.New("too many clients from address")
+)
+
 type ClientRegister struct {
 	mutex         sync.RWMutex
 	clients       map[uint32]*protocol.Client
+	clientsByAddr map[string]int
 	subscriptions *SubscriptionRegister
+	dispatcher    *Dispatcher
+	options       ClientRegisterOptions
 }
 
 func NewClientRegister() *ClientRegister {
+	return NewClientRegisterWithOptions(ClientRegisterOptions{})
+}
+
+func NewClientRegisterWithOptions(options ClientRegisterOptions) *ClientRegister {
+	shards := options.SubscriptionShards
+	if shards == 0 {
+		shards = DefaultSubscriptionShards
+	}
 	return &ClientRegister{
 		clients:       make(map[uint32]*protocol.Client),
-		subscriptions: NewSubscriptionRegister(),
+		clientsByAddr: make(map[string]int),
+		subscriptions: NewSubscriptionRegisterWithShards(shards),
+		dispatcher:    NewDispatcher(options.Dispatch),
+		options:       options,
 	}
 }
 
 func (cr *ClientRegister) AddClient(client *protocol.Client) {
+	cr.TryAddClient(client, 0, 0)
+}
+
+// TryAddClient adds client unless the register holds maxClients clients,
+// or maxPerAddr clients from the same remote address. Zero disables a limit.
+func (cr *ClientRegister) TryAddClient(client *protocol.Client, maxClients, maxPerAddr int) error {
+	addr := client.Peer().RemoteAddr
 	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
 	id := client.Id()
-	if old, ok := cr.clients[id]; ok {
+	old, replacing := cr.clients[id]
+	if !replacing {
+		if maxClients > 0 && len(cr.clients) >= maxClients {
+			return ErrTooManyClients
+		}
+		if maxPerAddr > 0 && addr != "" && cr.clientsByAddr[addr] >= maxPerAddr {
+			return ErrTooManyClientsFromAddr
+		}
+	} else {
 		old.Close()
-		delete(cr.clients, id)
+		cr.removeLocked(old)
 	}
 	cr.clients[id] = client
-	cr.mutex.Unlock()
+	if addr != "" {
+		cr.clientsByAddr[addr]++
+	}
+	return nil
+}
+
+// removeLocked forgets client, the caller must hold the write lock
+func (cr *ClientRegister) removeLocked(client *protocol.Client) {
+	delete(cr.clients, client.Id())
+	addr := client.Peer().RemoteAddr
+	if addr == "" {
+		return
+	}
+	if cr.clientsByAddr[addr] <= 1 {
+		delete(cr.clientsByAddr, addr)
+	} else {
+		cr.clientsByAddr[addr]--
+	}
+}
+
+// Close stops delivering published messages
+func (cr *ClientRegister) Close() {
+	cr.dispatcher.Close()
+}
+
+// ClientsFrom returns the number of clients from the remote address addr
+func (cr *ClientRegister) ClientsFrom(addr string) int {
+	cr.mutex.RLock()
+	defer cr.mutex.RUnlock()
+	return cr.clientsByAddr[addr]
 }
 
 func (cr *ClientRegister) GetClient(clientId uint32) *protocol.Client {
@@ -47,6 +127,34 @@ func (cr *ClientRegister) GetClient(clientId uint32) *protocol.Client {
 	return nil
 }
 
+// Clients returns the registered clients ordered by id
+func (cr *ClientRegister) Clients() []*protocol.Client {
+	cr.mutex.RLock()
+	clients := make([]*protocol.Client, 0, len(cr.clients))
+	for _, client := range cr.clients {
+		clients = append(clients, client)
+	}
+	cr.mutex.RUnlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Id() < clients[j].Id() })
+	return clients
+}
+
+// RemoveClient closes client and forgets it along with its subscriptions
+func (cr *ClientRegister) RemoveClient(client *protocol.Client) {
+	client.Close()
+	cr.subscriptions.RemoveSubscription(client, client.Subscriptions())
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+	if current, ok := cr.clients[client.Id()]; ok && current == client {
+		cr.removeLocked(client)
+	}
+}
+
+// SubscriberCounts returns the number of clients subscribed to each pattern
+func (cr *ClientRegister) SubscriberCounts() map[string]int {
+	return cr.subscriptions.SubscriberCounts()
+}
+
 func (cr *ClientRegister) AddSubscription(client *protocol.Client, patterns []string) {
 	cr.subscriptions.AddSubscription(client, patterns)
 }
@@ -57,6 +165,11 @@ func (cr *ClientRegister) RemoveSubscription(client *protocol.Client, patterns [
 
 func (cr *ClientRegister) Publish(msg protocol.Message) {
 	patterns := msg.Channel().Expand()
+	if cr.options.TagMatchedSubscriptions {
+		cr.publishTagged(msg, patterns)
+		return
+	}
+
 	subscribers := cr.subscriptions.GetSubscribers(patterns)
 	if len(subscribers) == 0 {
 		return
@@ -73,22 +186,50 @@ func (cr *ClientRegister) Publish(msg protocol.Message) {
 		return
 	}
 
-	go func(clients []*protocol.Client, msg protocol.Message) {
-		for _, client := range clients {
-			client.Send(msg, "")
+	cr.dispatcher.Dispatch(protocol.NewEncodedMessage(msg), clients...)
+}
+
+func (cr *ClientRegister) publishTagged(msg protocol.Message, patterns []string) {
+	matches := cr.subscriptions.GetMatches(patterns)
+	if len(matches) == 0 {
+		return
+	}
+
+	// Clients matched by the same set of patterns share one tagged copy
+	tagged := make(map[string]*protocol.EncodedMessage)
+	deliveries := make(map[string][]*protocol.Client)
+	for sub, matched := range matches {
+		client, ok := sub.(*protocol.Client)
+		if !ok {
+			continue
 		}
-	}(clients, msg)
+		sort.Strings(matched)
+		key := strings.Join(matched, " ")
+		if _, ok := tagged[key]; !ok {
+			m := protocol.Message{}
+			m.Update(msg)
+			m[protocol.SubscriptionsField] = matched
+			tagged[key] = protocol.NewEncodedMessage(m)
+		}
+		deliveries[key] = append(deliveries[key], client)
+	}
+
+	for key, clients := range deliveries {
+		cr.dispatcher.Dispatch(tagged[key], clients...)
+	}
 }
 
 func (cr *ClientRegister) Reap() *ClientRegisterCounters {
-	totals := ClientRegisterCounters{0, 0, 0, 0}
-	cr.mutex.RLock()
+	totals := ClientRegisterCounters{}
 	totals.SubscriberByPatternCount = cr.subscriptions.SubscriberByPatternCount.Load()
-	dead := []uint32{}
-	for id, client := range cr.clients {
+	totals.DispatchQueueDepth = cr.dispatcher.QueueDepth()
+	totals.DispatchDropped = cr.dispatcher.ResetDropped()
+
+	cr.mutex.RLock()
+	dead := []*protocol.Client{}
+	for _, client := range cr.clients {
 		if client.ShouldReap() {
-			cr.subscriptions.RemoveSubscription(client, client.Subscriptions())
-			dead = append(dead, id)
+			dead = append(dead, client)
 		}
 		c := client.ResetCounters()
 		totals.TotalFailed += c.Failed
@@ -96,10 +237,18 @@ func (cr *ClientRegister) Reap() *ClientRegisterCounters {
 	}
 	totals.Clients = uint(len(cr.clients) - len(dead))
 	cr.mutex.RUnlock()
+
 	if len(dead) > 0 {
+		// Subscriptions are dropped outside the client lock so publishes and
+		// lookups keep flowing while the reaper works through dead clients
+		for _, client := range dead {
+			cr.subscriptions.RemoveSubscription(client, client.Subscriptions())
+		}
 		cr.mutex.Lock()
-		for _, id := range dead {
-			delete(cr.clients, id)
+		for _, client := range dead {
+			if current, ok := cr.clients[client.Id()]; ok && current == client {
+				cr.removeLocked(client)
+			}
 		}
 		cr.mutex.Unlock()
 	}
@@ -0,0 +1,241 @@
+package memory
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Panicf(string, ...interface{}) {}
+
+type recordingConnection struct {
+	mutex    sync.Mutex
+	received []protocol.Message
+	closed   bool
+}
+
+func (rc *recordingConnection) Send(msgs []protocol.Message) error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	rc.received = append(rc.received, msgs...)
+	return nil
+}
+
+func (rc *recordingConnection) IsConnected() bool  { return !rc.closed }
+func (rc *recordingConnection) IsSingleShot() bool { return false }
+func (rc *recordingConnection) Close()             {}
+
+func (rc *recordingConnection) messages() []protocol.Message {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+	return append([]protocol.Message(nil), rc.received...)
+}
+
+func newConnectedClient(cr *ClientRegister, id uint32, patterns []string) *recordingConnection {
+	conn := &recordingConnection{}
+	client := protocol.NewClient(id, nopLogger{})
+	client.SetConnection(conn)
+	client.Subscribe(patterns)
+	cr.AddClient(client)
+	cr.AddSubscription(client, patterns)
+	return conn
+}
+
+func waitForMessages(t *testing.T, conn *recordingConnection, n int) []protocol.Message {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if msgs := conn.messages(); len(msgs) >= n {
+			time.Sleep(10 * time.Millisecond)
+			return conn.messages()
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d messages, got %d", n, len(conn.messages()))
+	return nil
+}
+
+func TestPublishDeliversOncePerClient(t *testing.T) {
+	cr := NewClientRegister()
+	defer cr.Close()
+	conn := newConnectedClient(cr, 1, []string{"/chat/**", "/chat/room1"})
+
+	cr.Publish(protocol.Message{"channel": "/chat/room1", "data": "hi"})
+
+	msgs := waitForMessages(t, conn, 1)
+	if len(msgs) != 1 {
+		t.Fatalf("received %d messages, want 1", len(msgs))
+	}
+	if _, ok := msgs[0][protocol.SubscriptionsField]; ok {
+		t.Errorf("untagged delivery carries %q", protocol.SubscriptionsField)
+	}
+}
+
+func TestPublishTagsMatchedSubscriptions(t *testing.T) {
+	cr := NewClientRegisterWithOptions(ClientRegisterOptions{TagMatchedSubscriptions: true})
+	defer cr.Close()
+	both := newConnectedClient(cr, 1, []string{"/chat/room1", "/chat/**"})
+	wildcard := newConnectedClient(cr, 2, []string{"/chat/*"})
+
+	msg := protocol.Message{"channel": "/chat/room1", "data": "hi"}
+	cr.Publish(msg)
+
+	tests := []struct {
+		name     string
+		conn     *recordingConnection
+		expected []string
+	}{
+		{"overlapping subscriptions", both, []string{"/chat/**", "/chat/room1"}},
+		{"single wildcard", wildcard, []string{"/chat/*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs := waitForMessages(t, tt.conn, 1)
+			if len(msgs) != 1 {
+				t.Fatalf("received %d messages, want 1", len(msgs))
+			}
+			if got := msgs[0][protocol.SubscriptionsField]; !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("%s = %v, want %v", protocol.SubscriptionsField, got, tt.expected)
+			}
+		})
+	}
+
+	if _, ok := msg[protocol.SubscriptionsField]; ok {
+		t.Errorf("Publish() modified the published message")
+	}
+}
+
+func TestReapRemovesDeadClients(t *testing.T) {
+	cr := NewClientRegister()
+	defer cr.Close()
+	newConnectedClient(cr, 1, []string{"/chat/room1"})
+	dead := newConnectedClient(cr, 2, []string{"/chat/room1", "/chat/**"})
+	dead.closed = true
+
+	counters := cr.Reap()
+	if counters.Clients != 1 {
+		t.Errorf("Reap() Clients = %d, want 1", counters.Clients)
+	}
+	if cr.GetClient(2) != nil {
+		t.Errorf("reaped client is still registered")
+	}
+	if got := cr.subscriptions.GetSubscribers([]string{"/chat/**"}); len(got) != 0 {
+		t.Errorf("reaped client still subscribed: %v", got)
+	}
+}
+
+func TestTryAddClientLimits(t *testing.T) {
+	cr := NewClientRegister()
+	defer cr.Close()
+	add := func(id uint32, addr string, maxClients, maxPerAddr int) error {
+		client := protocol.NewClient(id, nopLogger{})
+		client.SetPeer(protocol.PeerInfo{RemoteAddr: addr})
+		conn := &recordingConnection{}
+		client.SetConnection(conn)
+		err := cr.TryAddClient(client, maxClients, maxPerAddr)
+		if id == 1 {
+			conn.closed = true
+		}
+		return err
+	}
+
+	if err := add(1, "10.0.0.1", 3, 2); err != nil {
+		t.Fatalf("TryAddClient() = %v", err)
+	}
+	if err := add(2, "10.0.0.1", 3, 2); err != nil {
+		t.Fatalf("TryAddClient() = %v", err)
+	}
+	if err := add(3, "10.0.0.1", 3, 2); err != ErrTooManyClientsFromAddr {
+		t.Errorf("TryAddClient() = %v, want ErrTooManyClientsFromAddr", err)
+	}
+	if err := add(3, "10.0.0.2", 3, 2); err != nil {
+		t.Fatalf("TryAddClient() = %v", err)
+	}
+	if err := add(4, "10.0.0.3", 3, 2); err != ErrTooManyClients {
+		t.Errorf("TryAddClient() = %v, want ErrTooManyClients", err)
+	}
+
+	// Reaping frees the address of its dead client
+	cr.Reap()
+	if got := cr.ClientsFrom("10.0.0.1"); got != 1 {
+		t.Errorf("ClientsFrom() = %d after reap, want 1", got)
+	}
+	if err := add(4, "10.0.0.1", 3, 2); err != nil {
+		t.Errorf("TryAddClient() after reap = %v", err)
+	}
+}
+
+func TestPublishDuringReap(t *testing.T) {
+	cr := NewClientRegister()
+	defer cr.Close()
+	for i := uint32(1); i <= 200; i++ {
+		conn := newConnectedClient(cr, i, []string{"/chat/room1", "/chat/**"})
+		conn.closed = i%2 == 0
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 20; i++ {
+			cr.Reap()
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			cr.Publish(protocol.Message{"channel": "/chat/room1", "data": i})
+		}
+	}()
+	wg.Wait()
+
+	if got := cr.Reap().Clients; got != 100 {
+		t.Errorf("Clients = %d, want 100", got)
+	}
+}
+
+func BenchmarkPublishDuringReap(b *testing.B) {
+	cr := NewClientRegister()
+	defer cr.Close()
+	for i := uint32(1); i <= 5000; i++ {
+		conn := newConnectedClient(cr, i, []string{fmt.Sprintf("/chat/room%d", i%50)})
+		conn.closed = i%2 == 0
+	}
+	patterns := protocol.NewChannel("/chat/room1").Expand()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				cr.Reap()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			cr.subscriptions.GetSubscribers(patterns)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	<-done
+}
@@ -0,0 +1,179 @@
+package memory
+
+import (
+	"runtime"
+	"sync"
+
+	"github.com/dsablic/faye-go/protocol"
+	"go.uber.org/atomic"
+)
+
+type DispatcherOptions struct {
+	// Number of goroutines delivering messages, defaults to 4 per CPU
+	Workers int
+	// Maximum number of deliveries waiting across all clients
+	QueueSize int
+	// Maximum number of deliveries waiting for a single client
+	ClientQueueSize int
+}
+
+var DefaultDispatcherOptions = DispatcherOptions{
+	Workers:         4 * runtime.NumCPU(),
+	QueueSize:       1 << 16,
+	ClientQueueSize: 1024,
+}
+
+type mailbox struct {
+	client    *protocol.Client
+	msgs      []*protocol.EncodedMessage
+	scheduled bool
+}
+
+// Dispatcher fans published messages out on a fixed pool of workers. Each
+// client has its own mailbox that at most one worker drains at a time, so
+// deliveries to a client keep their order while a slow client only ties up
+// the worker currently serving it.
+type Dispatcher struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	mailboxes map[*protocol.Client]*mailbox
+	ready     []*mailbox
+	options   DispatcherOptions
+	depth     *atomic.Int64
+	dropped   *atomic.Uint64
+	closed    *atomic.Bool
+	workers   sync.WaitGroup
+}
+
+func NewDispatcher(options DispatcherOptions) *Dispatcher {
+	if options.Workers <= 0 {
+		options.Workers = DefaultDispatcherOptions.Workers
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultDispatcherOptions.QueueSize
+	}
+	if options.ClientQueueSize <= 0 {
+		options.ClientQueueSize = DefaultDispatcherOptions.ClientQueueSize
+	}
+
+	d := &Dispatcher{
+		mailboxes: make(map[*protocol.Client]*mailbox),
+		options:   options,
+		depth:     atomic.NewInt64(0),
+		dropped:   atomic.NewUint64(0),
+		closed:    atomic.NewBool(false),
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	d.workers.Add(options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+// Dispatch queues msg for every client and returns how many deliveries were
+// dropped because a queue was full.
+func (d *Dispatcher) Dispatch(msg *protocol.EncodedMessage, clients ...*protocol.Client) int {
+	dropped := 0
+	d.mutex.Lock()
+	for _, client := range clients {
+		if d.closed.Load() || d.depth.Load() >= int64(d.options.QueueSize) {
+			dropped++
+			continue
+		}
+		mb, ok := d.mailboxes[client]
+		if !ok {
+			mb = &mailbox{client: client}
+			d.mailboxes[client] = mb
+		}
+		if len(mb.msgs) >= d.options.ClientQueueSize {
+			dropped++
+			continue
+		}
+		mb.msgs = append(mb.msgs, msg)
+		d.depth.Inc()
+		if !mb.scheduled {
+			mb.scheduled = true
+			d.ready = append(d.ready, mb)
+			d.cond.Signal()
+		}
+	}
+	d.mutex.Unlock()
+
+	if dropped > 0 {
+		d.dropped.Add(uint64(dropped))
+	}
+	return dropped
+}
+
+// QueueDepth is the number of deliveries waiting to be sent
+func (d *Dispatcher) QueueDepth() int64 {
+	return d.depth.Load()
+}
+
+func (d *Dispatcher) ResetDropped() uint64 {
+	return d.dropped.Swap(0)
+}
+
+// Close stops the workers once the delivery each is making is done. Queued
+// and later deliveries are dropped, along with the rest of the batches the
+// workers took.
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	if d.closed.Load() {
+		d.mutex.Unlock()
+		return
+	}
+	d.closed.Store(true)
+	for _, mb := range d.mailboxes {
+		d.depth.Sub(int64(len(mb.msgs)))
+		d.dropped.Add(uint64(len(mb.msgs)))
+		mb.msgs = nil
+	}
+	d.mailboxes = make(map[*protocol.Client]*mailbox)
+	d.ready = nil
+	d.cond.Broadcast()
+	d.mutex.Unlock()
+	d.workers.Wait()
+}
+
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for {
+		d.mutex.Lock()
+		for len(d.ready) == 0 && !d.closed.Load() {
+			d.cond.Wait()
+		}
+		if d.closed.Load() {
+			d.mutex.Unlock()
+			return
+		}
+		mb := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+		msgs := mb.msgs
+		mb.msgs = nil
+		d.mutex.Unlock()
+
+		for i, msg := range msgs {
+			if d.closed.Load() {
+				rest := len(msgs) - i
+				d.depth.Sub(int64(rest))
+				d.dropped.Add(uint64(rest))
+				break
+			}
+			mb.client.SendEncoded(msg)
+			d.depth.Dec()
+		}
+
+		d.mutex.Lock()
+		if len(mb.msgs) > 0 && !d.closed.Load() {
+			d.ready = append(d.ready, mb)
+			d.cond.Signal()
+		} else {
+			mb.scheduled = false
+			delete(d.mailboxes, mb.client)
+		}
+		d.mutex.Unlock()
+	}
+}
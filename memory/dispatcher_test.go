@@ -0,0 +1,154 @@
+package memory
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+type blockingConnection struct {
+	recordingConnection
+	release chan struct{}
+}
+
+func (bc *blockingConnection) Send(msgs []protocol.Message) error {
+	<-bc.release
+	return bc.recordingConnection.Send(msgs)
+}
+
+func newClient(id uint32, conn protocol.Connection) *protocol.Client {
+	client := protocol.NewClient(id, nopLogger{})
+	client.SetConnection(conn)
+	return client
+}
+
+func TestDispatchPreservesPerClientOrder(t *testing.T) {
+	d := NewDispatcher(DispatcherOptions{Workers: 8})
+	defer d.Close()
+	conn := &recordingConnection{}
+	client := newClient(1, conn)
+
+	for i := 0; i < 100; i++ {
+		d.Dispatch(protocol.NewEncodedMessage(protocol.Message{"data": i}), client)
+	}
+
+	msgs := waitForMessages(t, conn, 100)
+	for i, msg := range msgs {
+		if msg["data"] != i {
+			t.Fatalf("message %d has data %v, deliveries out of order", i, msg["data"])
+		}
+	}
+}
+
+func TestDispatchIsolatesSlowClients(t *testing.T) {
+	d := NewDispatcher(DispatcherOptions{Workers: 2})
+	defer d.Close()
+	slow := &blockingConnection{release: make(chan struct{})}
+	defer close(slow.release)
+	fast := &recordingConnection{}
+
+	msg := protocol.NewEncodedMessage(protocol.Message{"data": "hi"})
+	d.Dispatch(msg, newClient(1, slow), newClient(2, fast))
+
+	waitForMessages(t, fast, 1)
+	if got := d.QueueDepth(); got != 1 {
+		t.Errorf("QueueDepth() = %d, want 1 while the slow client blocks", got)
+	}
+}
+
+func TestDispatchDropsWhenClientQueueFull(t *testing.T) {
+	d := NewDispatcher(DispatcherOptions{Workers: 1, ClientQueueSize: 2})
+	defer d.Close()
+	slow := &blockingConnection{release: make(chan struct{})}
+	client := newClient(1, slow)
+
+	d.Dispatch(protocol.NewEncodedMessage(protocol.Message{"data": 0}), client)
+	// Give the worker time to pick up the first delivery and block on it
+	time.Sleep(20 * time.Millisecond)
+
+	dropped := 0
+	for i := 1; i <= 4; i++ {
+		dropped += d.Dispatch(protocol.NewEncodedMessage(protocol.Message{"data": i}), client)
+	}
+	close(slow.release)
+
+	if dropped != 2 {
+		t.Errorf("dropped %d deliveries, want 2", dropped)
+	}
+	if got := d.ResetDropped(); got != 2 {
+		t.Errorf("ResetDropped() = %d, want 2", got)
+	}
+	waitForMessages(t, &slow.recordingConnection, 3)
+}
+
+func TestDispatcherClose(t *testing.T) {
+	d := NewDispatcher(DispatcherOptions{Workers: 1})
+	slow := &blockingConnection{release: make(chan struct{})}
+	client := newClient(1, slow)
+
+	d.Dispatch(protocol.NewEncodedMessage(protocol.Message{"data": 0}), client)
+	time.Sleep(20 * time.Millisecond)
+	d.Dispatch(protocol.NewEncodedMessage(protocol.Message{"data": 1}), client)
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+		t.Fatal("Close returned while a delivery was in progress")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(slow.release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the delivery finished")
+	}
+
+	if got := len(slow.messages()); got != 1 {
+		t.Errorf("delivered %d messages, want the one in progress", got)
+	}
+	if got := d.QueueDepth(); got != 0 {
+		t.Errorf("QueueDepth() = %d after Close, want 0", got)
+	}
+	if dropped := d.Dispatch(protocol.NewEncodedMessage(protocol.Message{"data": 2}), client); dropped != 1 {
+		t.Errorf("Dispatch after Close dropped %d, want 1", dropped)
+	}
+}
+
+func TestDispatcherCloseDropsTakenBatch(t *testing.T) {
+	d := NewDispatcher(DispatcherOptions{Workers: 1})
+	slow := &blockingConnection{release: make(chan struct{})}
+	client := newClient(1, slow)
+
+	// One Dispatch fills the mailbox before the worker takes it as a batch
+	msg := protocol.NewEncodedMessage(protocol.Message{"data": "hi"})
+	d.Dispatch(msg, client, client, client)
+	time.Sleep(20 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(slow.release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close did not return after the delivery finished")
+	}
+
+	if got := len(slow.messages()); got != 1 {
+		t.Errorf("delivered %d messages, want only the one in progress", got)
+	}
+	if got := d.QueueDepth(); got != 0 {
+		t.Errorf("QueueDepth() = %d after Close, want 0", got)
+	}
+	if got := d.ResetDropped(); got != 2 {
+		t.Errorf("dropped %d, want the 2 left in the batch", got)
+	}
+}
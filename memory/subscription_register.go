@@ -1,70 +1,131 @@
 package memory
 
 import (
+	"hash/fnv"
 	"sync"
 
 	"go.uber.org/atomic"
 )
 
+const DefaultSubscriptionShards = 64
+
 type interfaceMap map[interface{}]struct{}
 
+type subscriptionShard struct {
+	mutex               sync.RWMutex
+	subscriberByPattern map[string]interfaceMap
+}
+
+// SubscriptionRegister stripes patterns across independently locked shards
+// so subscribe churn on one pattern does not stall lookups of the others.
 type SubscriptionRegister struct {
-	subscriberByPattern      map[string]interfaceMap
+	shards                   []*subscriptionShard
 	SubscriberByPatternCount *atomic.Uint64
-	mutex                    sync.RWMutex
 }
 
 func NewSubscriptionRegister() *SubscriptionRegister {
+	return NewSubscriptionRegisterWithShards(DefaultSubscriptionShards)
+}
+
+func NewSubscriptionRegisterWithShards(count int) *SubscriptionRegister {
+	if count < 1 {
+		count = 1
+	}
+	shards := make([]*subscriptionShard, count)
+	for i := range shards {
+		shards[i] = &subscriptionShard{subscriberByPattern: make(map[string]interfaceMap)}
+	}
 	return &SubscriptionRegister{
-		subscriberByPattern:      make(map[string]interfaceMap),
+		shards:                   shards,
 		SubscriberByPatternCount: atomic.NewUint64(0),
 	}
 }
 
-func (sr *SubscriptionRegister) updateCounts() {
-	sr.SubscriberByPatternCount.Store(uint64(len(sr.subscriberByPattern)))
+func (sr *SubscriptionRegister) shardFor(pattern string) *subscriptionShard {
+	if len(sr.shards) == 1 {
+		return sr.shards[0]
+	}
+	h := fnv.New32a()
+	h.Write([]byte(pattern))
+	return sr.shards[h.Sum32()%uint32(len(sr.shards))]
 }
 
 func (sr *SubscriptionRegister) AddSubscription(subscriber interface{}, patterns []string) {
-	sr.mutex.Lock()
-	defer sr.mutex.Unlock()
-
 	for _, pattern := range patterns {
-		if _, ok := sr.subscriberByPattern[pattern]; !ok {
-			sr.subscriberByPattern[pattern] = make(interfaceMap)
+		shard := sr.shardFor(pattern)
+		shard.mutex.Lock()
+		if _, ok := shard.subscriberByPattern[pattern]; !ok {
+			shard.subscriberByPattern[pattern] = make(interfaceMap)
+			sr.SubscriberByPatternCount.Inc()
 		}
-		sr.subscriberByPattern[pattern][subscriber] = struct{}{}
+		shard.subscriberByPattern[pattern][subscriber] = struct{}{}
+		shard.mutex.Unlock()
 	}
-
-	sr.updateCounts()
 }
 
 func (sr *SubscriptionRegister) RemoveSubscription(subscriber interface{}, patterns []string) {
-	sr.mutex.Lock()
-	defer sr.mutex.Unlock()
-
 	for _, pattern := range patterns {
-		if subscribers, ok := sr.subscriberByPattern[pattern]; ok {
+		shard := sr.shardFor(pattern)
+		shard.mutex.Lock()
+		if subscribers, ok := shard.subscriberByPattern[pattern]; ok {
 			delete(subscribers, subscriber)
 			if len(subscribers) == 0 {
-				delete(sr.subscriberByPattern, pattern)
+				delete(shard.subscriberByPattern, pattern)
+				sr.SubscriberByPatternCount.Dec()
 			}
 		}
+		shard.mutex.Unlock()
 	}
-	sr.updateCounts()
 }
 
 func (sr *SubscriptionRegister) GetSubscribers(patterns []string) []interface{} {
 	arr := make([]interface{}, 0)
-	sr.mutex.RLock()
-	defer sr.mutex.RUnlock()
+	seen := make(interfaceMap)
 
 	for _, pattern := range patterns {
-		if subscribers, ok := sr.subscriberByPattern[pattern]; ok {
+		shard := sr.shardFor(pattern)
+		shard.mutex.RLock()
+		if subscribers, ok := shard.subscriberByPattern[pattern]; ok {
 			for subscriber := range subscribers {
+				if _, ok := seen[subscriber]; ok {
+					continue
+				}
+				seen[subscriber] = struct{}{}
 				arr = append(arr, subscriber)
 			}
 		}
+		shard.mutex.RUnlock()
 	}
 	return arr
 }
+
+// GetMatches returns each subscriber matching any of the patterns once,
+// along with the subscribed patterns that matched it.
+func (sr *SubscriptionRegister) GetMatches(patterns []string) map[interface{}][]string {
+	matches := make(map[interface{}][]string)
+
+	for _, pattern := range patterns {
+		shard := sr.shardFor(pattern)
+		shard.mutex.RLock()
+		if subscribers, ok := shard.subscriberByPattern[pattern]; ok {
+			for subscriber := range subscribers {
+				matches[subscriber] = append(matches[subscriber], pattern)
+			}
+		}
+		shard.mutex.RUnlock()
+	}
+	return matches
+}
+
+// SubscriberCounts returns the number of subscribers of each pattern
+func (sr *SubscriptionRegister) SubscriberCounts() map[string]int {
+	counts := make(map[string]int)
+	for _, shard := range sr.shards {
+		shard.mutex.RLock()
+		for pattern, subscribers := range shard.subscriberByPattern {
+			counts[pattern] = len(subscribers)
+		}
+		shard.mutex.RUnlock()
+	}
+	return counts
+}
@@ -0,0 +1,163 @@
+package memory
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+func TestGetSubscribersDeduplicates(t *testing.T) {
+	sr := NewSubscriptionRegister()
+	sr.AddSubscription("a", []string{"/chat/**", "/chat/room1"})
+	sr.AddSubscription("b", []string{"/chat/room1"})
+
+	got := sr.GetSubscribers([]string{"/**", "/chat/**", "/chat/*", "/chat/room1"})
+	if len(got) != 2 {
+		t.Fatalf("GetSubscribers() returned %d subscribers, want 2: %v", len(got), got)
+	}
+}
+
+func TestGetMatches(t *testing.T) {
+	sr := NewSubscriptionRegister()
+	sr.AddSubscription("a", []string{"/chat/**", "/chat/room1"})
+	sr.AddSubscription("b", []string{"/chat/*"})
+	sr.AddSubscription("c", []string{"/other"})
+
+	got := sr.GetMatches([]string{"/**", "/chat/**", "/chat/*", "/chat/room1"})
+	for _, patterns := range got {
+		sort.Strings(patterns)
+	}
+
+	expected := map[interface{}][]string{
+		"a": {"/chat/**", "/chat/room1"},
+		"b": {"/chat/*"},
+	}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("GetMatches() = %v, want %v", got, expected)
+	}
+}
+
+func TestSubscriberByPatternCount(t *testing.T) {
+	sr := NewSubscriptionRegisterWithShards(4)
+	sr.AddSubscription("a", []string{"/a", "/b", "/c"})
+	sr.AddSubscription("b", []string{"/a"})
+	if got := sr.SubscriberByPatternCount.Load(); got != 3 {
+		t.Errorf("SubscriberByPatternCount = %d, want 3", got)
+	}
+
+	sr.RemoveSubscription("a", []string{"/a", "/b"})
+	if got := sr.SubscriberByPatternCount.Load(); got != 2 {
+		t.Errorf("SubscriberByPatternCount = %d, want 2", got)
+	}
+}
+
+func TestConcurrentSubscribeAndLookup(t *testing.T) {
+	sr := NewSubscriptionRegister()
+	patterns := protocol.NewChannel("/chat/room1").Expand()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				sub := fmt.Sprintf("%d-%d", w, i)
+				pattern := patterns[i%len(patterns)]
+				sr.AddSubscription(sub, []string{pattern})
+				sr.RemoveSubscription(sub, []string{pattern})
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 500; i++ {
+				sr.GetSubscribers(patterns)
+				sr.GetMatches(patterns)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := sr.SubscriberByPatternCount.Load(); got != 0 {
+		t.Errorf("SubscriberByPatternCount = %d after churn, want 0", got)
+	}
+}
+
+func populate(sr *SubscriptionRegister, subscribers int) {
+	for i := 0; i < subscribers; i++ {
+		sr.AddSubscription(i, []string{fmt.Sprintf("/chat/room%d", i%100), "/chat/**"})
+	}
+}
+
+func benchmarkLookupWithChurn(b *testing.B, shards int) {
+	sr := NewSubscriptionRegisterWithShards(shards)
+	populate(sr, 10000)
+	patterns := protocol.NewChannel("/chat/room1").Expand()
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				sub := fmt.Sprintf("churn-%d", w)
+				pattern := []string{fmt.Sprintf("/other/%d", i%1000)}
+				sr.AddSubscription(sub, pattern)
+				sr.RemoveSubscription(sub, pattern)
+			}
+		}(w)
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sr.GetSubscribers(patterns)
+		}
+	})
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+}
+
+func BenchmarkGetSubscribersParallel(b *testing.B) {
+	sr := NewSubscriptionRegister()
+	populate(sr, 10000)
+	patterns := protocol.NewChannel("/chat/room1").Expand()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sr.GetSubscribers(patterns)
+		}
+	})
+}
+
+func BenchmarkGetSubscribersWithChurnSingleLock(b *testing.B) {
+	benchmarkLookupWithChurn(b, 1)
+}
+
+func BenchmarkGetSubscribersWithChurnSharded(b *testing.B) {
+	benchmarkLookupWithChurn(b, DefaultSubscriptionShards)
+}
+
+func BenchmarkSubscribeParallel(b *testing.B) {
+	sr := NewSubscriptionRegister()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			pattern := []string{fmt.Sprintf("/bench/%d", i%1000)}
+			sr.AddSubscription(i, pattern)
+			sr.RemoveSubscription(i, pattern)
+			i++
+		}
+	})
+}
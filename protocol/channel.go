@@ -82,3 +82,31 @@ func (c Channel) Expand() []string {
 	patterns[len(patterns)-1] = c.name
 	return patterns
 }
+
+// IsWildcard reports whether the channel is a pattern matching other
+// channels
+func (c Channel) IsWildcard() bool {
+	for _, segment := range strings.Split(c.name, "/") {
+		if segment == "*" || segment == "**" {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches reports whether the channel is matched by pattern, in which *
+// stands for one segment and a trailing ** for one or more. A wildcard
+// channel is only matched by patterns covering everything it matches.
+func (c Channel) Matches(pattern string) bool {
+	patternSegments := strings.Split(pattern, "/")
+	segments := strings.Split(c.name, "/")
+	for i, p := range patternSegments {
+		if p == "**" && i == len(patternSegments)-1 {
+			return len(segments) > i
+		}
+		if i >= len(segments) || (p != "*" && p != segments[i]) || (p == "*" && segments[i] == "**") {
+			return false
+		}
+	}
+	return len(patternSegments) == len(segments)
+}
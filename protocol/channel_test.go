@@ -97,3 +97,56 @@ func TestChannelExpand(t *testing.T) {
 		})
 	}
 }
+
+func TestChannelMatches(t *testing.T) {
+	tests := []struct {
+		channel  string
+		pattern  string
+		expected bool
+	}{
+		{"/foo/bar", "/foo/bar", true},
+		{"/foo/bar", "/foo/baz", false},
+		{"/foo/bar", "/foo/*", true},
+		{"/foo/bar/baz", "/foo/*", false},
+		{"/foo", "/foo/*", false},
+		{"/foo/bar", "/foo/**", true},
+		{"/foo/bar/baz", "/foo/**", true},
+		{"/foo", "/foo/**", false},
+		{"/foo/bar", "/**", true},
+		{"/foo/bar/baz", "/*/bar/*", true},
+		{"/foo/bar", "/foo/bar/baz", false},
+		{"/foo/*", "/foo/*", true},
+		{"/foo/*", "/foo/**", true},
+		{"/foo/**", "/foo/*", false},
+		{"/foo/**", "/foo/**", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.channel+" "+tt.pattern, func(t *testing.T) {
+			if got := NewChannel(tt.channel).Matches(tt.pattern); got != tt.expected {
+				t.Errorf("Channel(%q).Matches(%q) = %v, want %v", tt.channel, tt.pattern, got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestChannelIsWildcard(t *testing.T) {
+	tests := []struct {
+		channel  string
+		expected bool
+	}{
+		{"/foo/bar", false},
+		{"/foo/*", true},
+		{"/foo/**", true},
+		{"/**", true},
+		{"/foo/bar*", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.channel, func(t *testing.T) {
+			if got := NewChannel(tt.channel).IsWildcard(); got != tt.expected {
+				t.Errorf("Channel(%q).IsWildcard() = %v, want %v", tt.channel, got, tt.expected)
+			}
+		})
+	}
+}
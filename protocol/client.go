@@ -1,6 +1,7 @@
 package protocol
 
 import (
+	"errors"
 	"reflect"
 	"sync"
 	"sync/atomic"
@@ -16,6 +17,12 @@ type ClientCounters struct {
 
 type stringMap map[string]struct{}
 
+// Most messages held for a polling client between two requests
+const MaxQueuedMessages = 1000
+
+// How long a polling client may go without a request before it is reaped
+var PollingReapGrace = 2 * time.Duration(DefaultAdvice.Timeout) * time.Millisecond
+
 type Client struct {
 	clientId      uint32
 	connection    Connection
@@ -25,6 +32,10 @@ type Client struct {
 	logger        utils.Logger
 	counters      ClientCounters
 	subscriptions stringMap
+	queue         []Message
+	lastSeen      time.Time
+	peer          PeerInfo
+	principal     *Principal
 }
 
 func NewClient(clientId uint32, logger utils.Logger) *Client {
@@ -34,6 +45,7 @@ func NewClient(clientId uint32, logger utils.Logger) *Client {
 		logger:        logger,
 		counters:      ClientCounters{0, 0},
 		subscriptions: stringMap{},
+		lastSeen:      time.Now(),
 	}
 }
 
@@ -41,35 +53,148 @@ func (c *Client) Id() uint32 {
 	return c.clientId
 }
 
+// SetPeer records the remote end the client handshook from
+func (c *Client) SetPeer(peer PeerInfo) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.peer = peer
+}
+
+func (c *Client) Peer() PeerInfo {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.peer
+}
+
+// SetPrincipal records who the client authenticated as
+func (c *Client) SetPrincipal(principal *Principal) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.principal = principal
+}
+
+// Principal returns who the client authenticated as, nil when anonymous
+func (c *Client) Principal() *Principal {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.principal
+}
+
+// Connect answers a /meta/connect. Messages queued while a polling client
+// was between requests are returned right away, otherwise the reply is
+// held until a message arrives or the timeout passes.
 func (c *Client) Connect(timeout int, interval int, responseMsg Message, connection Connection) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	c.responseMsg = responseMsg
+	c.lastSeen = time.Now()
+
+	if connection.IsSingleShot() && len(c.queue) > 0 {
+		msgs := append(c.queue, responseMsg)
+		c.queue = nil
+		c.logger.Debugf("Flushing %d queued msgs to %d", len(msgs)-1, c.clientId)
+		if err := connection.Send(msgs); err != nil {
+			c.logger.Debugf("Failed to flush queue to %d: %v", c.clientId, err)
+			atomic.AddUint64(&c.counters.Failed, 1)
+			return
+		}
+		atomic.AddUint64(&c.counters.Sent, 1)
+		return
+	}
+
 	if timeout > 0 {
+		if holder, ok := connection.(Holder); ok {
+			holder.Hold()
+		}
 		clientId := c.clientId
 		logger := c.logger
-		go func(conn Connection, msg Message) {
-			time.Sleep(time.Duration(timeout) * time.Millisecond)
-			if c.isConnected() {
-				if err := conn.Send([]Message{msg}); err != nil {
+		time.AfterFunc(time.Duration(timeout)*time.Millisecond, func() {
+			if connection.IsConnected() {
+				if err := connection.Send([]Message{responseMsg}); err != nil {
 					logger.Debugf("Failed to send connect response to %d: %v", clientId, err)
 				}
 			} else {
 				logger.Debugf("No longer connected %d", clientId)
 			}
-		}(connection, responseMsg)
+		})
 	}
-	c.responseMsg = responseMsg
 }
 
+// SetConnection makes connection the one messages are delivered on. A poll
+// still held on the previous connection is answered so it can return.
 func (c *Client) SetConnection(connection Connection) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
+
+	old := c.connection
 	c.connection = connection
+	c.lastSeen = time.Now()
+
+	if old != nil && old != connection && old.IsSingleShot() && old.IsConnected() && c.responseMsg != nil {
+		if err := old.Send([]Message{c.responseMsg}); err != nil {
+			c.logger.Debugf("Failed to release superseded poll of %d: %v", c.clientId, err)
+		}
+	}
 }
 
+func (c *Client) Connection() Connection {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.connection
+}
+
+// IsStreaming reports whether the client is attached to a live connection
+// that outlasts a single request, such as a websocket or event stream
+func (c *Client) IsStreaming() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.connection != nil && !c.connection.IsSingleShot() && c.connection.IsConnected()
+}
+
+// ShouldReap reports whether the client is gone. Polling clients are
+// disconnected between requests, so they get a grace period.
 func (c *Client) ShouldReap() bool {
-	return !c.isConnected()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	switch {
+	case c.connection == nil:
+		return time.Since(c.lastSeen) > PollingReapGrace
+	case c.connection.IsConnected():
+		return false
+	case c.connection.IsSingleShot():
+		return time.Since(c.lastSeen) > PollingReapGrace
+	default:
+		return true
+	}
+}
+
+// Counters returns the messages sent and failed since the counters were
+// last reset
+func (c *Client) Counters() ClientCounters {
+	return ClientCounters{
+		Sent:   atomic.LoadUint64(&c.counters.Sent),
+		Failed: atomic.LoadUint64(&c.counters.Failed),
+	}
+}
+
+func (c *Client) Created() time.Time {
+	return c.created
+}
+
+// LastSeen returns when the client last made a request or held a connection
+func (c *Client) LastSeen() time.Time {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.lastSeen
+}
+
+// QueueLength returns the number of messages held for a polling client
+// between requests
+func (c *Client) QueueLength() int {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return len(c.queue)
 }
 
 func (c *Client) ResetCounters() ClientCounters {
@@ -87,38 +212,78 @@ func (c *Client) Close() {
 	}
 }
 
-func (c *Client) Send(msg Message, jsonp string) bool {
-	if c.isConnected() {
-		c.mutex.Lock()
-		defer c.mutex.Unlock()
-		msgs := []Message{msg}
-		if c.connection.IsSingleShot() {
-			msgs = append(msgs, c.responseMsg)
-		}
-		c.logger.Debugf("Sending %d msgs to %d on %s", len(msgs), c.clientId, reflect.TypeOf(c.connection))
+func (c *Client) Send(msg Message) bool {
+	return c.send(msg, nil)
+}
 
-		var err error
+// SendEncoded delivers a published message, reusing its encoding when the
+// connection supports it.
+func (c *Client) SendEncoded(em *EncodedMessage) bool {
+	return c.send(em.Message, em)
+}
 
-		if jsonp != "" {
-			err = c.connection.SendJsonp(msgs, jsonp)
-		} else {
-			err = c.connection.Send(msgs)
-		}
+func (c *Client) send(msg Message, encoded *EncodedMessage) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-		if err != nil {
-			c.logger.Debugf("Was unable to send %d messages to %d", len(msgs), c.clientId)
-			c.connection.Close()
-			atomic.AddUint64(&c.counters.Failed, 1)
-			return false
+	conn := c.connection
+	if conn == nil || !conn.IsConnected() {
+		if c.enqueue(msg) {
+			return true
 		}
+		c.logger.Debugf("Not connected for %d", c.clientId)
+		atomic.AddUint64(&c.counters.Failed, 1)
+		return false
+	}
 
-		atomic.AddUint64(&c.counters.Sent, 1)
-		return true
+	msgs := []Message{msg}
+	if conn.IsSingleShot() {
+		msgs = append(msgs, c.responseMsg)
 	}
+	c.logger.Debugf("Sending %d msgs to %d on %s", len(msgs), c.clientId, reflect.TypeOf(conn))
+
+	var err error
 
-	c.logger.Debugf("Not connected for %d", c.clientId)
-	atomic.AddUint64(&c.counters.Failed, 1)
-	return false
+	sender, canSendEncoded := conn.(EncodedSender)
+	if encoded != nil && canSendEncoded && len(msgs) == 1 {
+		err = sender.SendEncoded(encoded)
+	} else {
+		err = conn.Send(msgs)
+	}
+
+	if errors.Is(err, ErrDropped) {
+		c.logger.Debugf("Dropped %d messages to %d", len(msgs), c.clientId)
+		atomic.AddUint64(&c.counters.Failed, 1)
+		return false
+	}
+
+	if err != nil {
+		// A poll answered in the meantime, keep the message for the next one
+		if conn.IsSingleShot() && c.enqueue(msg) {
+			return true
+		}
+		c.logger.Debugf("Was unable to send %d messages to %d", len(msgs), c.clientId)
+		conn.Close()
+		atomic.AddUint64(&c.counters.Failed, 1)
+		return false
+	}
+
+	atomic.AddUint64(&c.counters.Sent, 1)
+	return true
+}
+
+// enqueue holds msg for a polling client that is between requests, the
+// caller must hold the client lock
+func (c *Client) enqueue(msg Message) bool {
+	if c.connection == nil || !c.connection.IsSingleShot() {
+		return false
+	}
+	if len(c.queue) >= MaxQueuedMessages {
+		c.logger.Debugf("Queue full for %d", c.clientId)
+		return false
+	}
+	c.queue = append(c.queue, msg)
+	return true
 }
 
 func (c *Client) Subscribe(patterns []string) {
@@ -141,6 +306,13 @@ func (c *Client) Unsubscribe(patterns []string) {
 	}
 }
 
+func (c *Client) IsSubscribed(pattern string) bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	_, ok := c.subscriptions[pattern]
+	return ok
+}
+
 func (c *Client) Subscriptions() []string {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
@@ -1,9 +1,46 @@
 package protocol
 
+import "errors"
+
+// ErrDropped is returned by a connection that discarded a message but is
+// otherwise still usable
+var ErrDropped = errors.New("message dropped")
+
 type Connection interface {
 	Send([]Message) error
-	SendJsonp([]Message, string) error
 	IsConnected() bool
 	IsSingleShot() bool
 	Close()
 }
+
+// Holder is implemented by request scoped connections that can be kept open
+// while a /meta/connect waits for messages
+type Holder interface {
+	Hold()
+}
+
+// EncodedSender is implemented by connections that can write a pre-encoded
+// message without marshaling it again.
+type EncodedSender interface {
+	SendEncoded(*EncodedMessage) error
+}
+
+// PeerInfo describes the remote end of a connection
+type PeerInfo struct {
+	// IP address of the peer, without port
+	RemoteAddr string
+	UserAgent  string
+}
+
+// Peer is implemented by connections that know their remote end
+type Peer interface {
+	Peer() PeerInfo
+}
+
+// PeerOf returns what is known about the remote end of conn
+func PeerOf(conn Connection) PeerInfo {
+	if p, ok := conn.(Peer); ok {
+		return p.Peer()
+	}
+	return PeerInfo{}
+}
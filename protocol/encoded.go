@@ -0,0 +1,56 @@
+package protocol
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// EncodedMessage is a published message that is marshaled at most once no
+// matter how many subscribers it is delivered to.
+type EncodedMessage struct {
+	Message Message
+
+	once  sync.Once
+	json  []byte
+	err   error
+	mutex sync.Mutex
+	frame interface{}
+}
+
+func NewEncodedMessage(msg Message) *EncodedMessage {
+	return &EncodedMessage{Message: msg}
+}
+
+// JSON returns the encoded message object
+func (em *EncodedMessage) JSON() ([]byte, error) {
+	em.once.Do(func() {
+		em.json, em.err = json.Marshal(em.Message)
+	})
+	return em.json, em.err
+}
+
+// Frame returns a transport specific representation of the message as a
+// single element Bayeux array, built by prepare on first use and cached.
+func (em *EncodedMessage) Frame(prepare func([]byte) (interface{}, error)) (interface{}, error) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	if em.frame != nil {
+		return em.frame, nil
+	}
+
+	js, err := em.JSON()
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, 0, len(js)+2)
+	payload = append(payload, '[')
+	payload = append(payload, js...)
+	payload = append(payload, ']')
+
+	frame, err := prepare(payload)
+	if err != nil {
+		return nil, err
+	}
+	em.frame = frame
+	return frame, nil
+}
@@ -8,6 +8,16 @@ import (
 
 const BayeuxVersion = "1.0"
 
+const (
+	ConnectionTypeWebsocket       = "websocket"
+	ConnectionTypeEventSource     = "eventsource"
+	ConnectionTypeLongPolling     = "long-polling"
+	ConnectionTypeCallbackPolling = "callback-polling"
+)
+
+// Field carrying the matched subscription patterns on tagged deliveries
+const SubscriptionsField = "subscriptions"
+
 type Advice struct {
 	Reconnect string `json:"reconnect"`
 	Interval  int    `json:"interval"`
@@ -27,21 +37,19 @@ func (m Message) Channel() Channel {
 
 func (m Message) ClientId() uint32 {
 	if clientId, ok := m["clientId"].(string); ok {
-		idStr := strings.TrimPrefix(clientId, "client-")
-		id, err := strconv.ParseInt(idStr, 10, 32)
-		if err != nil {
-			return 0
-		}
-		return uint32(id)
+		return ParseClientId(clientId)
 	}
 	return 0
 }
 
-func (m Message) Jsonp() string {
-	if jsonp, ok := m["jsonp"].(string); ok {
-		return jsonp
+// ParseClientId returns the numeric id of a "client-<n>" identifier, or 0
+func ParseClientId(clientId string) uint32 {
+	idStr := strings.TrimPrefix(clientId, "client-")
+	id, err := strconv.ParseInt(idStr, 10, 32)
+	if err != nil {
+		return 0
 	}
-	return ""
+	return uint32(id)
 }
 
 func (m Message) SetClientId(clientId uint32) {
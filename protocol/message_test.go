@@ -78,38 +78,6 @@ func TestMessageClientId(t *testing.T) {
 	}
 }
 
-func TestMessageJsonp(t *testing.T) {
-	tests := []struct {
-		name     string
-		message  Message
-		expected string
-	}{
-		{
-			name:     "has jsonp",
-			message:  Message{"jsonp": "callback"},
-			expected: "callback",
-		},
-		{
-			name:     "no jsonp",
-			message:  Message{},
-			expected: "",
-		},
-		{
-			name:     "wrong type",
-			message:  Message{"jsonp": 123},
-			expected: "",
-		},
-	}
-
-	for _, tt := range tests {
-		t.Run(tt.name, func(t *testing.T) {
-			if got := tt.message.Jsonp(); got != tt.expected {
-				t.Errorf("Message.Jsonp() = %q, want %q", got, tt.expected)
-			}
-		})
-	}
-}
-
 func TestMessageSetClientId(t *testing.T) {
 	m := Message{}
 	m.SetClientId(42)
@@ -0,0 +1,32 @@
+package protocol
+
+import (
+	"strconv"
+)
+
+// Principal is the identity a client authenticated as during handshake
+type Principal struct {
+	Subject string
+	// Claims carried by the credential, such as roles or tenant ids
+	Claims map[string]interface{}
+}
+
+// Attribute returns the subject for "sub", or the claim name as a string.
+// Only strings, numbers and booleans have a string form.
+func (p *Principal) Attribute(name string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	if name == "sub" && p.Subject != "" {
+		return p.Subject, true
+	}
+	switch v := p.Claims[name].(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	}
+	return "", false
+}
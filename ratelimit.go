@@ -0,0 +1,174 @@
+package faye
+
+import (
+	"hash/fnv"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+// Rate is a token bucket refilled with Limit tokens per second up to Burst,
+// each request takes one token. A zero Limit means unlimited.
+type Rate struct {
+	Limit float64
+	Burst int
+}
+
+func (r Rate) enabled() bool {
+	return r.Limit > 0
+}
+
+func (r Rate) burst() float64 {
+	if r.Burst < 1 {
+		return 1
+	}
+	return float64(r.Burst)
+}
+
+// RateLimit limits one kind of request per client and per remote IP
+type RateLimit struct {
+	PerClient Rate
+	PerIP     Rate
+}
+
+type RateLimits struct {
+	// Handshakes, only PerIP applies as the client has no id yet
+	Handshake RateLimit
+	Subscribe RateLimit
+	Publish   RateLimit
+	// Publishes to channels matching each pattern, shared by all clients
+	Channels map[string]Rate
+}
+
+func (rl RateLimits) enabled() bool {
+	return rl.Handshake.PerIP.enabled() ||
+		rl.Subscribe.PerClient.enabled() || rl.Subscribe.PerIP.enabled() ||
+		rl.Publish.PerClient.enabled() || rl.Publish.PerIP.enabled() ||
+		len(rl.Channels) > 0
+}
+
+const (
+	rateLimiterShards = 32
+	// Inserts into a shard between sweeps of its idle buckets
+	rateLimiterSweepEvery = 1024
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// When the bucket will be full again and can be forgotten
+	full time.Time
+}
+
+type rateLimiterShard struct {
+	mutex   sync.Mutex
+	buckets map[string]*tokenBucket
+	inserts int
+}
+
+// rateLimiter keeps token buckets by key, striped across shards so
+// unrelated clients do not contend on one lock
+type rateLimiter struct {
+	limits RateLimits
+	shards [rateLimiterShards]*rateLimiterShard
+	now    func() time.Time
+}
+
+func newRateLimiter(limits RateLimits) *rateLimiter {
+	rl := &rateLimiter{limits: limits, now: time.Now}
+	for i := range rl.shards {
+		rl.shards[i] = &rateLimiterShard{buckets: make(map[string]*tokenBucket)}
+	}
+	return rl
+}
+
+func (rl *rateLimiter) shardFor(key string) *rateLimiterShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return rl.shards[h.Sum32()%rateLimiterShards]
+}
+
+// take removes a token from the bucket under key, or returns how long until
+// one is available
+func (rl *rateLimiter) take(key string, rate Rate) (bool, time.Duration) {
+	if !rate.enabled() {
+		return true, 0
+	}
+	now := rl.now()
+	shard := rl.shardFor(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	b, ok := shard.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: rate.burst(), last: now}
+		shard.buckets[key] = b
+		if shard.inserts++; shard.inserts%rateLimiterSweepEvery == 0 {
+			shard.sweep(now)
+		}
+	}
+
+	b.tokens = math.Min(rate.burst(), b.tokens+now.Sub(b.last).Seconds()*rate.Limit)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate.Limit * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	b.full = now.Add(time.Duration((rate.burst() - b.tokens) / rate.Limit * float64(time.Second)))
+	return true, 0
+}
+
+func (shard *rateLimiterShard) sweep(now time.Time) {
+	for key, b := range shard.buckets {
+		if !now.Before(b.full) {
+			delete(shard.buckets, key)
+		}
+	}
+}
+
+// allow charges msg against every limit that applies to it, and returns
+// how long the client should wait when one of them is exhausted. Per client
+// limits apply to client, the registered client msg names, so spellings of
+// its id share a bucket and unknown ids don't get one. The address is
+// charged first, so a client can't drain its own bucket past the address's.
+func (rl *rateLimiter) allow(msg *protocol.Message, peer protocol.PeerInfo, client *protocol.Client) (bool, time.Duration) {
+	var limit RateLimit
+	var kind string
+	channel := msg.Channel()
+	switch channel.MetaType() {
+	case protocol.MetaHandshakeChannel:
+		limit, kind = RateLimit{PerIP: rl.limits.Handshake.PerIP}, "handshake"
+	case protocol.MetaSubscribeChannel:
+		limit, kind = rl.limits.Subscribe, "subscribe"
+	case nil:
+		limit, kind = rl.limits.Publish, "publish"
+	default:
+		return true, 0
+	}
+
+	if peer.RemoteAddr != "" {
+		if ok, wait := rl.take(kind+":ip:"+peer.RemoteAddr, limit.PerIP); !ok {
+			return false, wait
+		}
+	}
+	if client != nil {
+		if ok, wait := rl.take(kind+":client:"+strconv.FormatUint(uint64(client.Id()), 10), limit.PerClient); !ok {
+			return false, wait
+		}
+	}
+	if kind == "publish" {
+		for pattern, rate := range rl.limits.Channels {
+			if !channel.Matches(pattern) {
+				continue
+			}
+			if ok, wait := rl.take("channel:"+pattern, rate); !ok {
+				return false, wait
+			}
+		}
+	}
+	return true, 0
+}
@@ -0,0 +1,164 @@
+package faye
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := newRateLimiter(RateLimits{})
+	rl.now = func() time.Time { return now }
+	rate := Rate{Limit: 2, Burst: 3}
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.take("key", rate); !ok {
+			t.Fatalf("take %d refused within burst", i)
+		}
+	}
+	ok, wait := rl.take("key", rate)
+	if ok {
+		t.Fatalf("take allowed past burst")
+	}
+	if wait != 500*time.Millisecond {
+		t.Errorf("wait = %v, want 500ms", wait)
+	}
+
+	now = now.Add(wait)
+	if ok, _ := rl.take("key", rate); !ok {
+		t.Errorf("take refused after waiting")
+	}
+	if ok, _ := rl.take("other", rate); !ok {
+		t.Errorf("take on another key refused")
+	}
+}
+
+func TestTokenBucketSweep(t *testing.T) {
+	now := time.Unix(0, 0)
+	rl := newRateLimiter(RateLimits{})
+	rl.now = func() time.Time { return now }
+	rate := Rate{Limit: 1, Burst: 1}
+
+	for i := 0; i < rateLimiterShards*rateLimiterSweepEvery; i++ {
+		rl.take(fmt.Sprintf("client-%d", i), rate)
+		now = now.Add(time.Millisecond)
+	}
+	total := 0
+	for _, shard := range rl.shards {
+		total += len(shard.buckets)
+	}
+	if total >= rateLimiterShards*rateLimiterSweepEvery {
+		t.Errorf("%d buckets kept, want idle ones swept", total)
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	limits := RateLimits{
+		Handshake: RateLimit{PerIP: Rate{Limit: 1, Burst: 2}},
+		Subscribe: RateLimit{PerClient: Rate{Limit: 1, Burst: 1}},
+		Publish:   RateLimit{PerClient: Rate{Limit: 1, Burst: 3}},
+		Channels:  map[string]Rate{"/hot/**": {Limit: 1, Burst: 1}},
+	}
+	server := NewServerWithOptions(nopLogger{}, newTestEngine(t, EngineOptions{}), allowAll{}, ServerOptions{RateLimits: limits})
+	conn := &recordingConnection{peer: protocol.PeerInfo{RemoteAddr: "10.0.0.1"}}
+
+	send := func(msg protocol.Message) protocol.Message {
+		server.HandleRequest(map[string]interface{}(msg), conn)
+		return conn.last(t)
+	}
+	handshake := func() protocol.Message {
+		return send(protocol.Message{"channel": "/meta/handshake", "version": "1.0"})
+	}
+	assertLimited := func(response protocol.Message) {
+		t.Helper()
+		if response["successful"] != false {
+			t.Fatalf("response = %v, want rate limited", response)
+		}
+		if err, _ := response["error"].(string); !strings.HasPrefix(err, "429:") {
+			t.Errorf("error = %q, want 429", err)
+		}
+		advice, _ := response["advice"].(map[string]interface{})
+		if interval, _ := advice["interval"].(int); advice["reconnect"] != "retry" || interval <= 0 {
+			t.Errorf("advice = %v, want retry after an interval", advice)
+		}
+	}
+
+	clientId := handshake()["clientId"]
+	handshake()
+	assertLimited(handshake())
+
+	// Other addresses have their own handshake budget
+	conn.peer.RemoteAddr = "10.0.0.2"
+	if response := handshake(); response["successful"] != true {
+		t.Errorf("handshake from another address = %v", response)
+	}
+
+	subscribe := protocol.Message{"channel": "/meta/subscribe", "clientId": clientId, "subscription": "/foo"}
+	if response := send(subscribe); response["successful"] != true {
+		t.Fatalf("subscribe = %v", response)
+	}
+	response := send(subscribe)
+	assertLimited(response)
+	if response["subscription"] != "/foo" || response["clientId"] != clientId {
+		t.Errorf("response = %v, want the subscription and clientId echoed", response)
+	}
+
+	publish := func(channel string) protocol.Message {
+		return send(protocol.Message{"channel": channel, "clientId": clientId, "data": "x"})
+	}
+	if response := publish("/hot/news"); response["successful"] != true {
+		t.Fatalf("publish = %v", response)
+	}
+	assertLimited(publish("/hot/sports"))
+	if response := publish("/cold"); response["successful"] != true {
+		t.Fatalf("publish to unlimited channel = %v", response)
+	}
+	assertLimited(publish("/cold"))
+}
+
+func TestRateLimitKeysOnRegisteredClient(t *testing.T) {
+	limits := RateLimits{Subscribe: RateLimit{PerClient: Rate{Limit: 1, Burst: 1}}}
+	server := NewServerWithOptions(nopLogger{}, newTestEngine(t, EngineOptions{}), allowAll{}, ServerOptions{RateLimits: limits})
+	conn := &recordingConnection{peer: protocol.PeerInfo{RemoteAddr: "10.0.0.1"}}
+
+	subscribe := func(clientId string) protocol.Message {
+		server.HandleRequest(map[string]interface{}{"channel": "/meta/subscribe", "clientId": clientId, "subscription": "/foo"}, conn)
+		return conn.last(t)
+	}
+	server.HandleRequest(map[string]interface{}{"channel": "/meta/handshake", "version": "1.0"}, conn)
+	clientId := conn.last(t)["clientId"].(string)
+	id := protocol.ParseClientId(clientId)
+
+	if response := subscribe(clientId); response["successful"] != true {
+		t.Fatalf("subscribe = %v", response)
+	}
+	for _, variant := range []string{
+		fmt.Sprintf("%d", id),
+		fmt.Sprintf("client-0%d", id),
+		fmt.Sprintf("client-+%d", id),
+		fmt.Sprintf("00%d", id),
+	} {
+		if err, _ := subscribe(variant)["error"].(string); !strings.HasPrefix(err, "429:") {
+			t.Errorf("subscribe as %q got error %q, want 429 from the shared bucket", variant, err)
+		}
+	}
+
+	buckets := func() int {
+		total := 0
+		for _, shard := range server.limiter.shards {
+			total += len(shard.buckets)
+		}
+		return total
+	}
+	before := buckets()
+	for i := 0; i < 10; i++ {
+		subscribe(fmt.Sprintf("client-%d", 1000+i))
+	}
+	if after := buckets(); after != before {
+		t.Errorf("%d buckets kept for unknown clients", after-before)
+	}
+}
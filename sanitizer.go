@@ -0,0 +1,44 @@
+package faye
+
+import "github.com/dsablic/faye-go/protocol"
+
+// Sanitizer builds the message delivered to subscribers from an accepted
+// publish. The message must keep the channel of the publish, and the
+// publish itself must not be modified.
+type Sanitizer interface {
+	Sanitize(publish *protocol.Message) protocol.Message
+}
+
+type SanitizerFunc func(publish *protocol.Message) protocol.Message
+
+func (f SanitizerFunc) Sanitize(publish *protocol.Message) protocol.Message {
+	return f(publish)
+}
+
+// ForwardFields is a Sanitizer delivering the channel and data of a publish
+// along with the selected publisher fields
+type ForwardFields struct {
+	// The publisher's clientId, which lets any subscriber act as the
+	// publisher's session
+	ClientId bool
+	// The publisher's ext, which may carry credentials
+	Ext bool
+	// The message id chosen by the publisher
+	Id bool
+}
+
+// DefaultSanitizer forwards the message id only, like faye does
+var DefaultSanitizer Sanitizer = ForwardFields{Id: true}
+
+func (ff ForwardFields) Sanitize(publish *protocol.Message) protocol.Message {
+	msg := protocol.Message{
+		"channel": publish.Channel().Name(),
+		"data":    (*publish)["data"],
+	}
+	for field, forward := range map[string]bool{"clientId": ff.ClientId, "ext": ff.Ext, "id": ff.Id} {
+		if v, ok := (*publish)[field]; ok && forward {
+			msg[field] = v
+		}
+	}
+	return msg
+}
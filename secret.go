@@ -0,0 +1,69 @@
+package faye
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"sync/atomic"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+// DefaultSecretField is the ext field trusted publishers put the secret in
+const DefaultSecretField = "password"
+
+// publishSecrets holds the digests of the active secrets, so comparisons
+// take the same time whatever the length of the candidate
+type publishSecrets struct {
+	field   string
+	digests atomic.Value // [][sha256.Size]byte
+}
+
+func newPublishSecrets(field string, secrets []string) *publishSecrets {
+	if field == "" {
+		field = DefaultSecretField
+	}
+	ps := &publishSecrets{field: field}
+	ps.set(secrets)
+	return ps
+}
+
+func (ps *publishSecrets) set(secrets []string) {
+	digests := make([][sha256.Size]byte, 0, len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			digests = append(digests, sha256.Sum256([]byte(secret)))
+		}
+	}
+	ps.digests.Store(digests)
+}
+
+// take removes the secret from msg and reports whether it matched one of
+// the active secrets. Every secret is compared so the time taken does not
+// reveal which one matched.
+func (ps *publishSecrets) take(msg *protocol.Message) bool {
+	ext, ok := (*msg)["ext"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	candidate, present := ext[ps.field]
+	if !present {
+		return false
+	}
+	delete(ext, ps.field)
+	if len(ext) == 0 {
+		delete(*msg, "ext")
+	}
+
+	secret, ok := candidate.(string)
+	return ok && ps.matches(secret)
+}
+
+// matches reports whether secret is one of the active secrets
+func (ps *publishSecrets) matches(secret string) bool {
+	digest := sha256.Sum256([]byte(secret))
+	match := 0
+	for _, d := range ps.digests.Load().([][sha256.Size]byte) {
+		match |= subtle.ConstantTimeCompare(digest[:], d[:])
+	}
+	return match == 1
+}
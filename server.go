@@ -3,7 +3,7 @@ package faye
 import (
 	"encoding/json"
 	"fmt"
-	"net/url"
+	"time"
 
 	"github.com/dsablic/faye-go/protocol"
 	"github.com/dsablic/faye-go/utils"
@@ -14,10 +14,64 @@ type Validator interface {
 	PublishValid(*protocol.Message) bool
 }
 
+// Authenticator establishes who is handshaking. It returns a nil principal
+// to let the client in anonymously, and an error to refuse it.
+type Authenticator interface {
+	Authenticate(handshake *protocol.Message) (*protocol.Principal, error)
+}
+
+// Authorizer decides which channels a client may subscribe and publish to,
+// principal is nil for anonymous clients
+type Authorizer interface {
+	CanSubscribe(principal *protocol.Principal, channel string) bool
+	CanPublish(principal *protocol.Principal, channel string) bool
+}
+
+type ServerOptions struct {
+	// Token bucket limits on handshakes, subscribes and publishes, requests
+	// over the limit are refused with advice to retry later
+	RateLimits RateLimits
+	// Authenticates handshakes, the principal is kept on the client. Nil
+	// lets every client in anonymously.
+	Authenticator Authenticator
+	// Authorizes subscribes and publishes the Validator accepted, nil
+	// allows them all
+	Authorizer Authorizer
+	// When set, only messages carrying one of these secrets in ext may
+	// publish. Several secrets let backends move to a new one before the
+	// old is retired. Trusted publishes skip the Authorizer. Publishers
+	// with a Principal, see PublishFrom, need no secret when the
+	// Authorizer allows them; without an Authorizer they are refused.
+	PublishSecrets []string
+	// Ext field holding the secret, defaults to DefaultSecretField
+	SecretField string
+	// Ties each session to properties of its handshake
+	SessionBinding SessionBinding
+}
+
+// SessionBinding refuses requests presenting a clientId from a connection
+// that does not match the client's handshake, so a leaked clientId cannot
+// be used to take over the session
+type SessionBinding struct {
+	// Same remote IP as the handshake
+	RemoteAddr bool
+	// Same User-Agent as the handshake
+	UserAgent bool
+	// Every request authenticates, using the Authenticator, as the subject
+	// of the handshake. Event streams only carry the session's clientId and
+	// are checked against the other bindings.
+	Principal bool
+}
+
 type Server struct {
-	engine    *Engine
-	logger    utils.Logger
-	validator Validator
+	engine        *Engine
+	logger        utils.Logger
+	validator     Validator
+	limiter       *rateLimiter
+	authenticator Authenticator
+	authorizer    Authorizer
+	secrets       *publishSecrets
+	binding       SessionBinding
 }
 
 func (s *Server) Logger() utils.Logger {
@@ -25,13 +79,46 @@ func (s *Server) Logger() utils.Logger {
 }
 
 func NewServer(logger utils.Logger, engine *Engine, validator Validator) *Server {
-	return &Server{engine, logger, validator}
+	return NewServerWithOptions(logger, engine, validator, ServerOptions{})
+}
+
+func NewServerWithOptions(logger utils.Logger, engine *Engine, validator Validator, options ServerOptions) *Server {
+	server := &Server{
+		engine:        engine,
+		logger:        logger,
+		validator:     validator,
+		authenticator: options.Authenticator,
+		authorizer:    options.Authorizer,
+		binding:       options.SessionBinding,
+	}
+	if options.RateLimits.enabled() {
+		server.limiter = newRateLimiter(options.RateLimits)
+	}
+	if len(options.PublishSecrets) > 0 {
+		server.secrets = newPublishSecrets(options.SecretField, options.PublishSecrets)
+	}
+	return server
+}
+
+// OfferConnectionTypes adds the connection types a handler serves to those
+// offered in handshake, see Engine.OfferConnectionTypes
+func (s *Server) OfferConnectionTypes(types ...string) {
+	s.engine.OfferConnectionTypes(types...)
+}
+
+// SetPublishSecrets replaces the active publish secrets of a server created
+// with PublishSecrets
+func (s *Server) SetPublishSecrets(secrets []string) {
+	if s.secrets != nil {
+		s.secrets.set(secrets)
+	}
 }
 
 func (s *Server) HandleRequest(msges interface{}, conn protocol.Connection) {
 	if err := s.handleRequestInternal(msges, conn); err != nil {
 		s.logger.Debugf("Invalid message %v: %v", msges, err)
-		s.respondWithError(conn, "Invalid message")
+		request, _ := msges.(map[string]interface{})
+		s.respondWithError(request, conn, "Invalid message")
 	}
 }
 
@@ -45,8 +132,8 @@ func (s *Server) handleRequestInternal(msges interface{}, conn protocol.Connecti
 			}
 			var pm protocol.Message = m
 			s.handleMessage(&pm, conn)
-			return nil
 		}
+		return nil
 	case map[string]interface{}:
 		var m protocol.Message = v
 		if nested, ok := m["message"]; ok {
@@ -65,22 +152,6 @@ func (s *Server) handleRequestInternal(msges interface{}, conn protocol.Connecti
 		}
 		s.handleMessage(&m, conn)
 		return nil
-	case url.Values:
-		var msgList []map[string]interface{}
-		message := v.Get("message")
-		if err := json.Unmarshal([]byte(message), &msgList); err != nil {
-			var single map[string]interface{}
-			if err := json.Unmarshal([]byte(message), &single); err != nil {
-				return fmt.Errorf("failed to unmarshal message: %w", err)
-			}
-			msgList = append(msgList, single)
-		}
-		for _, msg := range msgList {
-			msg["jsonp"] = v.Get("jsonp")
-			var m protocol.Message = msg
-			s.handleMessage(&m, conn)
-		}
-		return nil
 	}
 	return fmt.Errorf("unexpected message type: %T", msges)
 }
@@ -90,24 +161,125 @@ func (s *Server) getClient(request *protocol.Message, conn protocol.Connection)
 }
 
 func (s *Server) handleMessage(msg *protocol.Message, conn protocol.Connection) {
+	// The secret is removed before anything else sees the message
+	trusted := false
+	if s.secrets != nil {
+		trusted = s.secrets.take(msg)
+	}
+
+	if s.limiter != nil {
+		if ok, wait := s.limiter.allow(msg, protocol.PeerOf(conn), s.getClient(msg, conn)); !ok {
+			s.logger.Debugf("Rate limited %s from %v", msg.Channel().Name(), protocol.PeerOf(conn).RemoteAddr)
+			s.respondRateLimited(msg, conn, wait)
+			return
+		}
+	}
+
 	channel := msg.Channel()
+	if !channel.IsMeta() {
+		if client := s.engine.GetClient(msg.ClientId()); client != nil && !s.checkBinding(client, msg, conn) {
+			s.respondSessionMismatch(msg, conn)
+			return
+		}
+	}
 	if channel.IsMeta() {
 		s.handleMeta(msg, conn)
 	} else {
-		if s.validator.PublishValid(msg) {
-			s.engine.Publish(msg, conn)
-		} else {
-			s.logger.Warnf("Invalid publish %v", msg)
-			s.respondWithError(conn, "Invalid publish")
+		var principal *protocol.Principal
+		if client := s.engine.GetClient(msg.ClientId()); client != nil {
+			principal = client.Principal()
 		}
+		s.publish(msg, principal, trusted, false, conn)
 	}
 }
 
+// Publisher makes publishes outside a client session, see PublishFrom
+type Publisher struct {
+	// Authorized by the Authorizer, nil for anonymous publishers. It stands
+	// in for a publish secret as long as the server has an Authorizer.
+	Principal *protocol.Principal
+	// Presented one of the publish secrets, so the Authorizer is skipped
+	Trusted bool
+}
+
+// PublishFrom publishes msg on behalf of publisher, with the checks applied
+// to publishes from clients, and sends the response to conn. It lets other
+// protocols publish without a session.
+func (s *Server) PublishFrom(msg *protocol.Message, publisher Publisher, conn protocol.Connection) {
+	trusted := publisher.Trusted
+	if s.secrets != nil && s.secrets.take(msg) {
+		trusted = true
+	}
+	if s.limiter != nil {
+		if ok, wait := s.limiter.allow(msg, protocol.PeerOf(conn), nil); !ok {
+			s.respondRateLimited(msg, conn, wait)
+			return
+		}
+	}
+	// The caller verified the principal, so the Authorizer decides in
+	// place of a secret. Without one it would allow any channel.
+	delegated := publisher.Principal != nil && s.authorizer != nil
+	s.publish(msg, publisher.Principal, trusted, delegated, conn)
+}
+
+// IsPublishSecret reports whether secret is one of the active publish
+// secrets
+func (s *Server) IsPublishSecret(secret string) bool {
+	return s.secrets != nil && s.secrets.matches(secret)
+}
+
+func (s *Server) publish(msg *protocol.Message, principal *protocol.Principal, trusted, delegated bool, conn protocol.Connection) {
+	channel := msg.Channel()
+	if !s.validator.PublishValid(msg) {
+		s.logger.Warnf("Invalid publish %v", msg)
+		s.respondWithError(*msg, conn, "Invalid publish")
+	} else if s.secrets != nil && !trusted && !delegated {
+		s.logger.Debugf("Publish to %s by %v without secret", channel.Name(), msg.ClientId())
+		conn.Send([]protocol.Message{errorResponse(msg, 403, channel.Name(), "Forbidden")})
+	} else if !trusted && s.authorizer != nil && !s.authorizer.CanPublish(principal, channel.Name()) {
+		s.logger.Debugf("Unauthorized publish to %s by %v", channel.Name(), msg.ClientId())
+		conn.Send([]protocol.Message{errorResponse(msg, 403, channel.Name(), "Forbidden")})
+	} else {
+		s.engine.Publish(msg, conn)
+	}
+}
+
+// unauthorizedSubscription returns the first subscription in msg the client
+// may not make, or an empty string
+func (s *Server) unauthorizedSubscription(msg *protocol.Message, client *protocol.Client) string {
+	if s.authorizer == nil {
+		return ""
+	}
+	_, subs := s.engine.subscriptionResponse(msg)
+	for _, sub := range subs {
+		if !s.authorizer.CanSubscribe(client.Principal(), sub) {
+			return sub
+		}
+	}
+	return ""
+}
+
+// handshake authenticates the client before the engine admits it
+func (s *Server) handshake(msg *protocol.Message, conn protocol.Connection) {
+	var principal *protocol.Principal
+	if s.authenticator != nil {
+		var err error
+		if principal, err = s.authenticator.Authenticate(msg); err != nil {
+			s.logger.Infof("Handshake from %s refused: %v", protocol.PeerOf(conn).RemoteAddr, err)
+			response := errorResponse(msg, 401, "", "Authentication failed")
+			response["advice"] = map[string]interface{}{"reconnect": "none"}
+			conn.Send([]protocol.Message{response})
+			return
+		}
+	}
+	s.engine.HandshakeAs(msg, conn, principal)
+}
+
 func (s *Server) handleMeta(msg *protocol.Message, conn protocol.Connection) {
 	metaChannel := msg.Channel().MetaType()
 
 	if metaChannel == protocol.MetaHandshakeChannel {
-		s.engine.Handshake(msg, conn)
+		s.handshake(msg, conn)
 		return
 	}
 
@@ -121,7 +293,19 @@ func (s *Server) handleMeta(msg *protocol.Message, conn protocol.Connection) {
 		return
 	}
 
-	client.SetConnection(conn)
+	if !s.checkBinding(client, msg, conn) {
+		s.respondSessionMismatch(msg, conn)
+		return
+	}
+
+	// Requests posted alongside an event stream are answered over the
+	// stream. Otherwise a poll only becomes the delivery connection through
+	// /meta/connect, other requests are simply answered in their response.
+	if conn.IsSingleShot() && client.IsStreaming() {
+		conn = client.Connection()
+	} else if !conn.IsSingleShot() || metaChannel == protocol.MetaConnectChannel {
+		client.SetConnection(conn)
+	}
 
 	switch metaChannel {
 	case protocol.MetaConnectChannel:
@@ -129,21 +313,116 @@ func (s *Server) handleMeta(msg *protocol.Message, conn protocol.Connection) {
 	case protocol.MetaDisconnectChannel:
 		s.engine.Disconnect(msg, client, conn)
 	case protocol.MetaUnsubscribeChannel:
-		s.engine.UnsubscribeClient(msg, client)
+		s.engine.UnsubscribeClient(msg, client, conn)
 	case protocol.MetaSubscribeChannel:
-		if s.validator.SubscribeValid(msg) {
-			s.engine.SubscribeClient(msg, client)
-		} else {
+		if !s.validator.SubscribeValid(msg) {
 			s.logger.Warnf("Invalid subscription %v", msg)
-			s.respondWithError(conn, "Invalid subscription")
+			s.respondWithError(*msg, conn, "Invalid subscription")
+		} else if sub := s.unauthorizedSubscription(msg, client); sub != "" {
+			s.logger.Debugf("Unauthorized subscription to %s by %d", sub, client.Id())
+			conn.Send([]protocol.Message{errorResponse(msg, 403, sub, "Forbidden")})
+		} else {
+			s.engine.SubscribeClient(msg, client, conn)
 		}
 	case protocol.MetaUnknownChannel:
 		s.logger.Errorf("Message with unknown meta channel received")
 	}
 }
 
-func (s *Server) respondWithError(conn protocol.Connection, err string) {
-	response := protocol.Message{}
-	response["error"] = err
+// AttachConnection makes conn the delivery connection of an existing client,
+// used by transports that open their stream after the handshake
+func (s *Server) AttachConnection(clientId string, conn protocol.Connection) bool {
+	client := s.engine.GetClient(protocol.ParseClientId(clientId))
+	if client == nil || !s.checkBinding(client, nil, conn) {
+		return false
+	}
+	client.SetConnection(conn)
+	return true
+}
+
+// checkBinding reports whether a request for client, arriving on conn, comes
+// from the session's owner. msg is nil for connections without a request.
+// Mismatches are logged as security events.
+func (s *Server) checkBinding(client *protocol.Client, msg *protocol.Message, conn protocol.Connection) bool {
+	bound, peer := client.Peer(), protocol.PeerOf(conn)
+	mismatch := ""
+	switch {
+	case s.binding.RemoteAddr && peer.RemoteAddr != bound.RemoteAddr:
+		mismatch = fmt.Sprintf("remote address %q, bound to %q", peer.RemoteAddr, bound.RemoteAddr)
+	case s.binding.UserAgent && peer.UserAgent != bound.UserAgent:
+		mismatch = fmt.Sprintf("user agent %q, bound to %q", peer.UserAgent, bound.UserAgent)
+	case s.binding.Principal && msg != nil:
+		if subject, want := s.requestSubject(msg), subjectOf(client.Principal()); subject != want {
+			mismatch = fmt.Sprintf("principal %q, bound to %q", subject, want)
+		}
+	}
+	if mismatch == "" {
+		return true
+	}
+	s.logger.Warnf("Security: session %d presented with %s from %s", client.Id(), mismatch, peer.RemoteAddr)
+	return false
+}
+
+// requestSubject authenticates a request of an established session, an
+// unauthenticated request has no subject
+func (s *Server) requestSubject(msg *protocol.Message) string {
+	if s.authenticator == nil {
+		return ""
+	}
+	principal, err := s.authenticator.Authenticate(msg)
+	if err != nil {
+		return ""
+	}
+	return subjectOf(principal)
+}
+
+func subjectOf(principal *protocol.Principal) string {
+	if principal == nil {
+		return ""
+	}
+	return principal.Subject
+}
+
+func (s *Server) respondSessionMismatch(request *protocol.Message, conn protocol.Connection) {
+	response := errorResponse(request, 401, "", "Session mismatch")
+	response["advice"] = map[string]interface{}{"reconnect": "handshake"}
+	conn.Send([]protocol.Message{response})
+}
+
+// respondWithError refuses a request the validator rejected, or nil when
+// it could not be read. The error keeps its plain text, the request's id
+// and channel are echoed so the sender can tell which request failed.
+func (s *Server) respondWithError(request protocol.Message, conn protocol.Connection, err string) {
+	response := protocol.Message{"successful": false, "error": err}
+	for _, field := range []string{"id", "channel", "clientId", "subscription"} {
+		if v, ok := request[field]; ok {
+			response[field] = v
+		}
+	}
+	conn.Send([]protocol.Message{response})
+}
+
+// errorResponse answers request with a Bayeux error formatted as
+// code:args:message
+func errorResponse(request *protocol.Message, code int, args string, message string) protocol.Message {
+	response := protocol.Message{
+		"channel":    request.Channel().Name(),
+		"successful": false,
+		"error":      fmt.Sprintf("%d:%s:%s", code, args, message),
+	}
+	for _, field := range []string{"id", "clientId", "subscription"} {
+		if v, ok := (*request)[field]; ok {
+			response[field] = v
+		}
+	}
+	return response
+}
+
+func (s *Server) respondRateLimited(request *protocol.Message, conn protocol.Connection, wait time.Duration) {
+	response := errorResponse(request, 429, request.Channel().Name(), "Too many requests")
+	response["advice"] = map[string]interface{}{
+		"reconnect": "retry",
+		"interval":  int((wait + time.Millisecond - 1) / time.Millisecond),
+	}
 	conn.Send([]protocol.Message{response})
 }
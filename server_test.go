@@ -0,0 +1,367 @@
+package faye
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/auth"
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/transport"
+)
+
+type allowAll struct{}
+
+func (allowAll) SubscribeValid(*protocol.Message) bool { return true }
+func (allowAll) PublishValid(*protocol.Message) bool   { return true }
+
+func newTestServer(t *testing.T) *Server {
+	return NewServer(nopLogger{}, newTestEngine(t, EngineOptions{}), allowAll{})
+}
+
+type pollResult struct {
+	msgs []protocol.Message
+	err  error
+}
+
+// longPoll posts body through the long-polling transport
+func longPoll(server *Server, body string) <-chan pollResult {
+	result := make(chan pollResult, 1)
+	go func() {
+		var msgs interface{}
+		if err := json.Unmarshal([]byte(body), &msgs); err != nil {
+			result <- pollResult{err: err}
+			return
+		}
+		w := httptest.NewRecorder()
+		transport.MakeLongPoll(msgs, server, w, httptest.NewRequest("POST", "/bayeux", nil))
+		var response []protocol.Message
+		err := json.Unmarshal(w.Body.Bytes(), &response)
+		result <- pollResult{response, err}
+	}()
+	return result
+}
+
+func awaitPoll(t *testing.T, result <-chan pollResult) []protocol.Message {
+	t.Helper()
+	select {
+	case r := <-result:
+		if r.err != nil {
+			t.Fatalf("poll failed: %v", r.err)
+		}
+		return r.msgs
+	case <-time.After(2 * time.Second):
+		t.Fatalf("poll was not answered")
+		return nil
+	}
+}
+
+func assertHeld(t *testing.T, result <-chan pollResult) {
+	t.Helper()
+	select {
+	case r := <-result:
+		t.Fatalf("poll answered early with %v", r.msgs)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func channels(msgs []protocol.Message) []string {
+	names := make([]string, len(msgs))
+	for i, msg := range msgs {
+		names[i] = msg.Channel().Name()
+	}
+	return names
+}
+
+func handshake(t *testing.T, server *Server) string {
+	t.Helper()
+	msgs := awaitPoll(t, longPoll(server, `{"channel":"/meta/handshake","version":"1.0"}`))
+	clientId, ok := msgs[0]["clientId"].(string)
+	if !ok {
+		t.Fatalf("handshake failed: %v", msgs)
+	}
+	return clientId
+}
+
+func connectBody(clientId string) string {
+	return `{"channel":"/meta/connect","clientId":"` + clientId + `","connectionType":"long-polling"}`
+}
+
+func TestLongPollHoldsConnectUntilMessages(t *testing.T) {
+	server := newTestServer(t)
+	clientId := handshake(t, server)
+
+	msgs := awaitPoll(t, longPoll(server,
+		`[{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/chat"},
+		  {"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/news"}]`))
+	if got := channels(msgs); len(got) != 2 {
+		t.Fatalf("batched subscribe answered with %v, want both replies", got)
+	}
+
+	poll := longPoll(server, connectBody(clientId))
+	assertHeld(t, poll)
+
+	publisher := handshake(t, server)
+	awaitPoll(t, longPoll(server, `{"channel":"/chat","clientId":"`+publisher+`","data":"hi"}`))
+
+	msgs = awaitPoll(t, poll)
+	got := channels(msgs)
+	if len(got) != 2 || got[0] != "/chat" || got[1] != "/meta/connect" {
+		t.Errorf("held poll answered with %v, want [/chat /meta/connect]", got)
+	}
+}
+
+func TestLongPollReturnsQueuedMessages(t *testing.T) {
+	server := newTestServer(t)
+	clientId := handshake(t, server)
+	awaitPoll(t, longPoll(server, `{"channel":"/meta/subscribe","clientId":"`+clientId+`","subscription":"/chat"}`))
+
+	// The first connect makes the client a polling client, publishing
+	// releases it and the rest are queued until the next connect
+	poll := longPoll(server, connectBody(clientId))
+	assertHeld(t, poll)
+	publisher := handshake(t, server)
+	for i := 0; i < 3; i++ {
+		awaitPoll(t, longPoll(server, `{"channel":"/chat","clientId":"`+publisher+`","data":"hi"}`))
+	}
+	awaitPoll(t, poll)
+	time.Sleep(50 * time.Millisecond)
+
+	msgs := awaitPoll(t, longPoll(server, connectBody(clientId)))
+	got := channels(msgs)
+	if len(got) < 2 || got[len(got)-1] != "/meta/connect" {
+		t.Fatalf("connect answered with %v, want queued messages then the reply", got)
+	}
+	if len(got) != 3 {
+		t.Errorf("connect returned %d messages, want the 2 queued ones and the reply", len(got))
+	}
+}
+
+func TestLongPollSupersededByNewPoll(t *testing.T) {
+	server := newTestServer(t)
+	clientId := handshake(t, server)
+
+	first := longPoll(server, connectBody(clientId))
+	assertHeld(t, first)
+
+	second := longPoll(server, connectBody(clientId))
+	msgs := awaitPoll(t, first)
+	if got := channels(msgs); len(got) != 1 || got[0] != "/meta/connect" {
+		t.Errorf("superseded poll answered with %v, want [/meta/connect]", got)
+	}
+	assertHeld(t, second)
+}
+
+func TestAuthentication(t *testing.T) {
+	key := []byte("secret")
+	server := NewServerWithOptions(nopLogger{}, newTestEngine(t, EngineOptions{}), allowAll{}, ServerOptions{
+		Authenticator: &auth.JWTAuthenticator{Keys: auth.StaticKey(key)},
+		Authorizer:    auth.Rules{{Pattern: "/users/{sub}/**", Subscribe: true, Publish: true}},
+	})
+	conn := &recordingConnection{}
+	send := func(msg protocol.Message) protocol.Message {
+		server.HandleRequest(map[string]interface{}(msg), conn)
+		return conn.last(t)
+	}
+
+	response := send(protocol.Message{"channel": "/meta/handshake", "version": "1.0"})
+	if response["successful"] != false || response["error"] != "401::Authentication failed" {
+		t.Fatalf("handshake without token = %v", response)
+	}
+	if advice, _ := response["advice"].(map[string]interface{}); advice["reconnect"] != "none" {
+		t.Errorf("advice = %v, want reconnect none", advice)
+	}
+
+	token, _ := auth.SignHS256(map[string]interface{}{"sub": "42"}, "", key)
+	response = send(protocol.Message{"channel": "/meta/handshake", "version": "1.0", "ext": map[string]interface{}{"authToken": token}})
+	clientId, _ := response["clientId"].(string)
+	if clientId == "" {
+		t.Fatalf("handshake with token = %v", response)
+	}
+	if principal := server.engine.GetClient(protocol.ParseClientId(clientId)).Principal(); principal == nil || principal.Subject != "42" {
+		t.Errorf("client principal = %v, want subject 42", principal)
+	}
+
+	subscribe := func(sub string) protocol.Message {
+		return send(protocol.Message{"channel": "/meta/subscribe", "clientId": clientId, "subscription": sub})
+	}
+	if response := subscribe("/users/42/**"); response["successful"] != true {
+		t.Errorf("subscribe to own channels = %v", response)
+	}
+	if response := subscribe("/users/43/**"); response["error"] != "403:/users/43/**:Forbidden" {
+		t.Errorf("subscribe to other user = %v", response)
+	}
+
+	publish := func(channel string) protocol.Message {
+		return send(protocol.Message{"channel": channel, "clientId": clientId, "data": "hi"})
+	}
+	if response := publish("/users/42/inbox"); response["successful"] != true {
+		t.Errorf("publish to own channel = %v", response)
+	}
+	if response := publish("/users/43/inbox"); response["error"] != "403:/users/43/inbox:Forbidden" {
+		t.Errorf("publish to other user = %v", response)
+	}
+}
+
+// recordingValidator accepts everything and keeps the publishes it saw
+type recordingValidator struct {
+	publishes []protocol.Message
+}
+
+func (rv *recordingValidator) SubscribeValid(*protocol.Message) bool { return true }
+func (rv *recordingValidator) PublishValid(msg *protocol.Message) bool {
+	rv.publishes = append(rv.publishes, *msg)
+	return true
+}
+
+func TestPublishSecrets(t *testing.T) {
+	validator := &recordingValidator{}
+	server := NewServerWithOptions(nopLogger{}, newTestEngine(t, EngineOptions{}), validator, ServerOptions{
+		PublishSecrets: []string{"old", "new"},
+	})
+	conn := &recordingConnection{}
+	publish := func(ext map[string]interface{}) protocol.Message {
+		msg := protocol.Message{"channel": "/news", "data": "hi"}
+		if ext != nil {
+			msg["ext"] = ext
+		}
+		server.HandleRequest(map[string]interface{}(msg), conn)
+		return conn.last(t)
+	}
+
+	tests := []struct {
+		name       string
+		ext        map[string]interface{}
+		successful bool
+	}{
+		{"no secret", nil, false},
+		{"wrong secret", map[string]interface{}{"password": "guess"}, false},
+		{"secret of other type", map[string]interface{}{"password": 42}, false},
+		{"current secret", map[string]interface{}{"password": "new"}, true},
+		{"previous secret", map[string]interface{}{"password": "old", "trace": "abc"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if response := publish(tt.ext); response["successful"] != tt.successful {
+				t.Errorf("publish = %v, want successful %v", response, tt.successful)
+			}
+		})
+	}
+
+	for _, msg := range validator.publishes {
+		if ext, ok := msg["ext"].(map[string]interface{}); ok {
+			if _, leaked := ext["password"]; leaked {
+				t.Errorf("secret reached the validator: %v", msg)
+			}
+		}
+	}
+	if last := validator.publishes[len(validator.publishes)-1]; last["ext"] == nil {
+		t.Errorf("other ext fields were dropped: %v", last)
+	}
+
+	server.SetPublishSecrets([]string{"newer"})
+	if response := publish(map[string]interface{}{"password": "old"}); response["successful"] != false {
+		t.Errorf("publish with retired secret = %v", response)
+	}
+	if response := publish(map[string]interface{}{"password": "newer"}); response["successful"] != true {
+		t.Errorf("publish with rotated secret = %v", response)
+	}
+}
+
+func TestSessionBinding(t *testing.T) {
+	key := []byte("secret")
+	owner := protocol.PeerInfo{RemoteAddr: "10.0.0.1", UserAgent: "browser"}
+	token := func(sub string) map[string]interface{} {
+		jwt, _ := auth.SignHS256(map[string]interface{}{"sub": sub}, "", key)
+		return map[string]interface{}{"authToken": jwt}
+	}
+
+	tests := []struct {
+		name    string
+		binding SessionBinding
+		peer    protocol.PeerInfo
+		ext     map[string]interface{}
+		allowed bool
+	}{
+		{"unbound", SessionBinding{}, protocol.PeerInfo{RemoteAddr: "10.0.0.2"}, nil, true},
+		{"same address", SessionBinding{RemoteAddr: true}, protocol.PeerInfo{RemoteAddr: "10.0.0.1", UserAgent: "curl"}, nil, true},
+		{"other address", SessionBinding{RemoteAddr: true}, protocol.PeerInfo{RemoteAddr: "10.0.0.2", UserAgent: "browser"}, nil, false},
+		{"other user agent", SessionBinding{UserAgent: true}, protocol.PeerInfo{RemoteAddr: "10.0.0.1", UserAgent: "curl"}, nil, false},
+		{"same principal", SessionBinding{Principal: true}, owner, token("42"), true},
+		{"other principal", SessionBinding{Principal: true}, owner, token("43"), false},
+		{"missing token", SessionBinding{Principal: true}, owner, nil, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := NewServerWithOptions(nopLogger{}, newTestEngine(t, EngineOptions{}), allowAll{}, ServerOptions{
+				Authenticator:  &auth.JWTAuthenticator{Keys: auth.StaticKey(key), Optional: true},
+				SessionBinding: tt.binding,
+			})
+			send := func(msg protocol.Message, peer protocol.PeerInfo) protocol.Message {
+				conn := &recordingConnection{peer: peer}
+				server.HandleRequest(map[string]interface{}(msg), conn)
+				return conn.last(t)
+			}
+
+			response := send(protocol.Message{"channel": "/meta/handshake", "version": "1.0", "ext": token("42")}, owner)
+			clientId, _ := response["clientId"].(string)
+			if clientId == "" {
+				t.Fatalf("handshake = %v", response)
+			}
+
+			requests := []protocol.Message{
+				{"channel": "/meta/subscribe", "clientId": clientId, "subscription": "/chat"},
+				{"channel": "/chat", "clientId": clientId, "data": "hi"},
+			}
+			for _, request := range requests {
+				if tt.ext != nil {
+					request["ext"] = tt.ext
+				}
+				response := send(request, tt.peer)
+				if tt.allowed {
+					if response["successful"] != true {
+						t.Errorf("%s = %v, want success", request.Channel().Name(), response)
+					}
+					continue
+				}
+				if response["successful"] != false || response["error"] != "401::Session mismatch" {
+					t.Errorf("%s = %v, want session mismatch", request.Channel().Name(), response)
+				}
+				if advice, _ := response["advice"].(map[string]interface{}); advice["reconnect"] != "handshake" {
+					t.Errorf("advice = %v, want reconnect handshake", advice)
+				}
+			}
+
+			attached := server.AttachConnection(clientId, &recordingConnection{peer: tt.peer})
+			if want := tt.allowed || tt.binding.Principal; attached != want {
+				t.Errorf("attach = %v, want %v", attached, want)
+			}
+		})
+	}
+}
+
+type refuseAll struct{}
+
+func (refuseAll) SubscribeValid(*protocol.Message) bool { return false }
+func (refuseAll) PublishValid(*protocol.Message) bool   { return false }
+
+func TestValidatorErrorsEchoRequest(t *testing.T) {
+	server := NewServer(nopLogger{}, newTestEngine(t, EngineOptions{}), refuseAll{})
+	conn := &recordingConnection{}
+	server.HandleRequest(map[string]interface{}{"channel": "/meta/handshake", "version": "1.0"}, conn)
+	clientId := conn.last(t)["clientId"]
+
+	server.HandleRequest(map[string]interface{}{"channel": "/news", "clientId": clientId, "data": "hi", "id": "7"}, conn)
+	want := protocol.Message{"channel": "/news", "clientId": clientId, "id": "7", "successful": false, "error": "Invalid publish"}
+	if response := conn.last(t); !reflect.DeepEqual(response, want) {
+		t.Errorf("refused publish = %v, want %v", response, want)
+	}
+
+	server.HandleRequest(map[string]interface{}{"channel": "/meta/subscribe", "clientId": clientId, "subscription": "/news", "id": "8"}, conn)
+	if response := conn.last(t); response["id"] != "8" || response["error"] != "Invalid subscription" {
+		t.Errorf("refused subscribe = %v", response)
+	}
+}
@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+)
+
+var validJSONPCallback = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+
+func isValidJSONPCallback(callback string) bool {
+	if len(callback) > 128 {
+		return false
+	}
+	return validJSONPCallback.MatchString(callback)
+}
+
+// CallbackPollingConnection answers a single GET request with a script
+// calling the client supplied callback, for browsers without CORS.
+type CallbackPollingConnection struct {
+	*LongPollingConnection
+	callback string
+}
+
+func NewCallbackPollingConnection(callback string) *CallbackPollingConnection {
+	return &CallbackPollingConnection{NewLongPollingConnection(), callback}
+}
+
+func MakeCallbackPoll(msgs interface{}, callback string, server Server, w http.ResponseWriter, r *http.Request) {
+	MakeCallbackPollWithOptions(msgs, callback, server, w, r, PollOptions{})
+}
+
+func MakeCallbackPollWithOptions(msgs interface{}, callback string, server Server, w http.ResponseWriter, r *http.Request, options PollOptions) {
+	if !isValidJSONPCallback(callback) {
+		server.Logger().Warnf("Invalid JSONP callback name: %s", callback)
+		http.Error(w, "Invalid JSONP callback", http.StatusBadRequest)
+		return
+	}
+
+	conn := NewCallbackPollingConnection(callback)
+	conn.peer = PeerFromRequest(r)
+	responseMsgs, ok := poll(msgs, server, conn, r)
+	if !ok {
+		return
+	}
+	responseMsgs = options.adviseMultipleClients(responseMsgs)
+
+	bs, err := json.Marshal(responseMsgs)
+	if err != nil {
+		server.Logger().Warnf("While encoding response msgs: %s", err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/javascript; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Disposition", "attachment; filename=f.txt")
+	h.Set("Cache-Control", "no-cache, no-store")
+
+	body := make([]byte, 0, len(bs)+len(conn.callback)+8)
+	body = append(body, "/**/"...)
+	body = append(body, conn.callback...)
+	body = append(body, '(')
+	body = append(body, bs...)
+	body = append(body, ");"...)
+	setWriteDeadline(w, PollWriteTimeout)
+	if _, err := w.Write(body); err != nil {
+		server.Logger().Warnf("While writing HTTP response: %s", err)
+	}
+}
@@ -0,0 +1,73 @@
+package transport
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+
+	"go.uber.org/atomic"
+)
+
+// WebsocketStats counts the data written to websocket connections, so the
+// effect of compression can be observed. Control frames are not counted.
+type WebsocketStats struct {
+	// Payload bytes handed to the writers, before compression
+	PayloadBytes *atomic.Uint64
+	// Bytes those payloads took on the wire, including frame headers.
+	// Only counted on connections upgraded through CountWireBytes.
+	WireBytes *atomic.Uint64
+	// Data frames written
+	Frames *atomic.Uint64
+}
+
+func NewWebsocketStats() *WebsocketStats {
+	return &WebsocketStats{
+		PayloadBytes: atomic.NewUint64(0),
+		WireBytes:    atomic.NewUint64(0),
+		Frames:       atomic.NewUint64(0),
+	}
+}
+
+// countingConn counts the bytes written to a hijacked connection
+type countingConn struct {
+	net.Conn
+	written *atomic.Uint64
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+type countingResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, brw, err := h.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &countingConn{Conn: conn, written: atomic.NewUint64(0)}, brw, nil
+}
+
+// CountWireBytes wraps the ResponseWriter of a websocket upgrade, so the
+// connection reports the bytes its frames take on the wire to
+// WebsocketStats
+func CountWireBytes(w http.ResponseWriter) http.ResponseWriter {
+	return countingResponseWriter{w}
+}
+
+// bytesWritten returns the bytes written so far to conn, and false when
+// they are not counted
+func bytesWritten(conn net.Conn) (uint64, bool) {
+	if cc, ok := conn.(*countingConn); ok {
+		return cc.written.Load(), true
+	}
+	return 0, false
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// newCompressedPair returns a server side connection, counting its wire
+// bytes, and the client it talks to
+func newCompressedPair(t *testing.T, compress bool, options WebsocketOptions) (*WebSocketConnection, *websocket.Conn) {
+	t.Helper()
+	upgrader := websocket.Upgrader{EnableCompression: compress}
+	conns := make(chan *websocket.Conn, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(CountWireBytes(w), r, nil)
+		if err != nil {
+			t.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- ws
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{EnableCompression: compress}
+	client, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ws := <-conns
+	t.Cleanup(func() { ws.Close() })
+	return NewWebSocketConnection(ws, options), client
+}
+
+func TestCompression(t *testing.T) {
+	large := protocol.Message{"channel": "/foo", "data": strings.Repeat("compressible ", 100)}
+
+	tests := []struct {
+		name       string
+		compress   bool
+		threshold  int
+		compressed bool
+	}{
+		{"above threshold", true, 256, true},
+		{"below threshold", true, 4096, false},
+		{"not negotiated", false, 256, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options := DefaultWebsocketOptions
+			options.CompressionLevel = 9
+			options.CompressionThreshold = tt.threshold
+			options.Stats = NewWebsocketStats()
+			conn, client := newCompressedPair(t, tt.compress, options)
+
+			if err := conn.SendEncoded(protocol.NewEncodedMessage(large)); err != nil {
+				t.Fatalf("SendEncoded() error = %v", err)
+			}
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			var got []protocol.Message
+			if err := client.ReadJSON(&got); err != nil {
+				t.Fatalf("ReadJSON: %v", err)
+			}
+			if len(got) != 1 || got[0]["data"] != large["data"] {
+				t.Errorf("received %v, want [%v]", got, large)
+			}
+
+			// The writer records a frame, after its bytes, once it is on the wire
+			deadline := time.Now().Add(time.Second)
+			for options.Stats.Frames.Load() == 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			js, _ := json.Marshal(large)
+			payload, wire := options.Stats.PayloadBytes.Load(), options.Stats.WireBytes.Load()
+			if payload != uint64(len(js)+2) {
+				t.Errorf("payload bytes = %d, want %d", payload, len(js)+2)
+			}
+			if options.Stats.Frames.Load() != 1 {
+				t.Errorf("frames = %d, want 1", options.Stats.Frames.Load())
+			}
+			if compressed := wire < payload; compressed != tt.compressed {
+				t.Errorf("wire bytes = %d for %d payload bytes, want compressed %v", wire, payload, tt.compressed)
+			}
+		})
+	}
+}
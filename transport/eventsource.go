@@ -0,0 +1,166 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/utils"
+	"go.uber.org/atomic"
+)
+
+type EventSourceOptions struct {
+	// How often a comment is written to keep proxies from timing out the
+	// stream and to detect peers that went away, zero disables it
+	PingInterval time.Duration
+	// Reconnection delay suggested to the browser
+	Retry time.Duration
+	// Number of sends buffered while the stream is being written
+	SendQueueSize int
+	// Longest a write to the stream may take before the client is
+	// considered gone, zero disables it
+	WriteTimeout time.Duration
+}
+
+var DefaultEventSourceOptions = EventSourceOptions{
+	PingInterval:  15 * time.Second,
+	Retry:         time.Second,
+	SendQueueSize: 256,
+	WriteTimeout:  10 * time.Second,
+}
+
+// EventSourceConnection streams messages to a client over a long lived
+// text/event-stream response. The client posts its own messages separately.
+type EventSourceConnection struct {
+	outbox    chan []byte
+	closed    *atomic.Bool
+	done      chan struct{}
+	closeOnce sync.Once
+	options   EventSourceOptions
+	peer      protocol.PeerInfo
+}
+
+func NewEventSourceConnection(options EventSourceOptions) *EventSourceConnection {
+	if options.SendQueueSize <= 0 {
+		options.SendQueueSize = DefaultEventSourceOptions.SendQueueSize
+	}
+	return &EventSourceConnection{
+		outbox:  make(chan []byte, options.SendQueueSize),
+		closed:  atomic.NewBool(false),
+		done:    make(chan struct{}),
+		options: options,
+	}
+}
+
+func (es *EventSourceConnection) Send(msgs []protocol.Message) error {
+	bs, err := json.Marshal(msgs)
+	if err != nil {
+		return err
+	}
+	return es.enqueue(bs)
+}
+
+func (es *EventSourceConnection) SendEncoded(em *protocol.EncodedMessage) error {
+	js, err := em.JSON()
+	if err != nil {
+		return err
+	}
+	bs := make([]byte, 0, len(js)+2)
+	bs = append(bs, '[')
+	bs = append(bs, js...)
+	bs = append(bs, ']')
+	return es.enqueue(bs)
+}
+
+func (es *EventSourceConnection) enqueue(bs []byte) error {
+	if !es.IsConnected() {
+		return errors.New("not connected")
+	}
+	select {
+	case es.outbox <- bs:
+		return nil
+	default:
+		es.Close()
+		return errors.New("send queue full, connection closed")
+	}
+}
+
+func (es *EventSourceConnection) IsConnected() bool {
+	return !es.closed.Load()
+}
+
+func (es *EventSourceConnection) IsSingleShot() bool {
+	return false
+}
+
+// SetPeer records the remote end of the stream, it must be called before
+// the connection is attached to a client
+func (es *EventSourceConnection) SetPeer(peer protocol.PeerInfo) {
+	es.peer = peer
+}
+
+func (es *EventSourceConnection) Peer() protocol.PeerInfo {
+	return es.peer
+}
+
+func (es *EventSourceConnection) Close() {
+	es.closed.Store(true)
+	es.closeOnce.Do(func() { close(es.done) })
+}
+
+// Serve writes queued messages as events until the connection is closed or
+// the client goes away.
+func (es *EventSourceConnection) Serve(w http.ResponseWriter, r *http.Request, logger utils.Logger) {
+	defer es.Close()
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache, no-store")
+	h.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	setWriteDeadline(w, es.options.WriteTimeout)
+	if _, err := fmt.Fprintf(w, "retry: %d\r\n\r\n", es.options.Retry.Milliseconds()); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	var pings <-chan time.Time
+	if es.options.PingInterval > 0 {
+		ticker := time.NewTicker(es.options.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	for {
+		var err error
+		select {
+		case <-es.done:
+			return
+		case <-r.Context().Done():
+			logger.Debugf("Event stream closed by client")
+			return
+		case <-pings:
+			setWriteDeadline(w, es.options.WriteTimeout)
+			_, err = w.Write([]byte(":\r\n\r\n"))
+		case bs := <-es.outbox:
+			setWriteDeadline(w, es.options.WriteTimeout)
+			_, err = fmt.Fprintf(w, "data: %s\r\n\r\n", bs)
+		}
+		if err != nil {
+			logger.Debugf("While writing event stream: %s", err)
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+func TestEventSourceStreamsMessages(t *testing.T) {
+	conn := NewEventSourceConnection(EventSourceOptions{Retry: 2 * time.Second})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn.Serve(w, r, nopLogger{})
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	if err := conn.Send([]protocol.Message{{"channel": "/foo", "data": "one"}}); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+	em := protocol.NewEncodedMessage(protocol.Message{"channel": "/foo", "data": "two"})
+	if err := conn.SendEncoded(em); err != nil {
+		t.Fatalf("SendEncoded() error = %v", err)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- strings.TrimRight(scanner.Text(), "\r")
+		}
+		close(lines)
+	}()
+
+	next := func() string {
+		select {
+		case line := <-lines:
+			return line
+		case <-time.After(time.Second):
+			t.Fatalf("timed out reading event stream")
+			return ""
+		}
+	}
+
+	if got := next(); got != "retry: 2000" {
+		t.Errorf("first line = %q, want retry: 2000", got)
+	}
+
+	var events []string
+	for len(events) < 2 {
+		if line := next(); strings.HasPrefix(line, "data: ") {
+			events = append(events, strings.TrimPrefix(line, "data: "))
+		}
+	}
+
+	for i, expected := range []string{"one", "two"} {
+		var msgs []protocol.Message
+		if err := json.Unmarshal([]byte(events[i]), &msgs); err != nil {
+			t.Fatalf("invalid event %q: %v", events[i], err)
+		}
+		if len(msgs) != 1 || msgs[0]["data"] != expected {
+			t.Errorf("event %d = %v, want data %q", i, msgs, expected)
+		}
+	}
+
+	conn.Close()
+	if conn.Send([]protocol.Message{{}}) == nil {
+		t.Errorf("Send() on a closed stream succeeded")
+	}
+}
+
+func TestEventSourceClosedWhenClientLeaves(t *testing.T) {
+	conn := NewEventSourceConnection(DefaultEventSourceOptions)
+	served := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn.Serve(w, r, nopLogger{})
+		close(served)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("Serve() did not return after the client went away")
+	}
+	if conn.IsConnected() {
+		t.Errorf("IsConnected() = true after the client went away")
+	}
+}
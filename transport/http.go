@@ -3,44 +3,127 @@ package transport
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"net/http"
-	"regexp"
+	"sync"
+	"time"
 
 	"github.com/dsablic/faye-go/protocol"
 	"go.uber.org/atomic"
 )
 
-var validJSONPCallback = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.]*$`)
+// Longest a poll is held, in case its connect reply never arrives
+var MaxPollDuration = 2 * time.Duration(protocol.DefaultAdvice.Timeout) * time.Millisecond
 
+// Longest writing a poll response may take, so a client that stopped
+// reading does not hold the handler, zero disables it
+var PollWriteTimeout = 10 * time.Second
+
+// setWriteDeadline bounds the next writes to w, when the server supports it
+func setWriteDeadline(w http.ResponseWriter, timeout time.Duration) {
+	if timeout > 0 {
+		http.NewResponseController(w).SetWriteDeadline(time.Now().Add(timeout))
+	}
+}
+
+type PollOptions struct {
+	// Reports, when the response is written, whether other clients in the
+	// same browser are polling too
+	MultipleClients func() bool
+	// Interval in milliseconds advised to clients sharing a browser, so they
+	// do not exhaust its connection limit
+	MultipleClientsInterval int
+}
+
+// adviseMultipleClients rewrites the connect replies in msgs to tell the
+// client it shares its browser with other polling clients
+func (o PollOptions) adviseMultipleClients(msgs []protocol.Message) []protocol.Message {
+	if o.MultipleClients == nil || !o.MultipleClients() {
+		return msgs
+	}
+	advised := make([]protocol.Message, len(msgs))
+	for i, msg := range msgs {
+		advised[i] = msg
+		if msg.Channel().MetaType() != protocol.MetaConnectChannel {
+			continue
+		}
+		reply := protocol.Message{}
+		reply.Update(msg)
+		reply["advice"] = map[string]interface{}{
+			"reconnect":        protocol.DefaultAdvice.Reconnect,
+			"interval":         o.MultipleClientsInterval,
+			"timeout":          protocol.DefaultAdvice.Timeout,
+			"multiple-clients": true,
+		}
+		advised[i] = reply
+	}
+	return advised
+}
+
+// LongPollingConnection collects the responses to one HTTP request. A request
+// carrying /meta/connect is held until the connect reply is sent, which
+// happens once messages are available for the client or the advice timeout
+// passes, so everything delivered in the meantime goes out in one array.
+// A connect reply sent while the request is being handled only marks the
+// response ready, so replies to the rest of the batch still join it.
 type LongPollingConnection struct {
-	responseChan chan []protocol.Message
-	Closed       *atomic.Bool
-	jsonp        *atomic.String
+	mutex     sync.Mutex
+	pending   []protocol.Message
+	flushed   chan struct{}
+	flushOnce sync.Once
+	held      bool
+	handling  bool
+	ready     bool
+	peer      protocol.PeerInfo
+	Closed    *atomic.Bool
 }
 
 func NewLongPollingConnection() *LongPollingConnection {
-	return &LongPollingConnection{make(chan []protocol.Message, 1), atomic.NewBool(false), atomic.NewString("")}
+	return &LongPollingConnection{
+		pending: []protocol.Message{},
+		flushed: make(chan struct{}),
+		Closed:  atomic.NewBool(false),
+	}
 }
 
-func (lp *LongPollingConnection) enqueueMessages(msgs []protocol.Message) error {
-	select {
-	case lp.responseChan <- msgs:
-		return nil
-	default:
-		return errors.New("response channel is full")
+func (lp *LongPollingConnection) Send(msgs []protocol.Message) error {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	if lp.Closed.Load() {
+		return errors.New("response already sent")
+	}
+	lp.pending = append(lp.pending, msgs...)
+	if containsConnect(msgs) {
+		if lp.handling {
+			lp.ready = true
+		} else {
+			lp.flush()
+		}
 	}
+	return nil
 }
 
-func (lp *LongPollingConnection) Send(msgs []protocol.Message) error {
-	lp.Close()
-	return lp.enqueueMessages(msgs)
+// handle passes the request to server, and sends the response once the
+// whole batch was answered unless a connect holds it
+func (lp *LongPollingConnection) handle(msgs interface{}, server Server, pc pollingConnection) {
+	lp.mutex.Lock()
+	lp.handling = true
+	lp.mutex.Unlock()
+
+	server.HandleRequest(msgs, pc)
+
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	lp.handling = false
+	if lp.ready || !lp.held {
+		lp.flush()
+	}
 }
 
-func (lp *LongPollingConnection) SendJsonp(msgs []protocol.Message, jsonp string) error {
-	lp.Close()
-	lp.jsonp.Store(jsonp)
-	return lp.enqueueMessages(msgs)
+// Hold keeps the request open until the connect reply is sent
+func (lp *LongPollingConnection) Hold() {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	lp.held = true
 }
 
 func (lp *LongPollingConnection) IsConnected() bool {
@@ -48,53 +131,93 @@ func (lp *LongPollingConnection) IsConnected() bool {
 }
 
 func (lp *LongPollingConnection) Close() {
-	lp.Closed.Store(true)
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	lp.flush()
 }
 
 func (lp *LongPollingConnection) IsSingleShot() bool {
 	return true
 }
 
-func isValidJSONPCallback(callback string) bool {
-	if len(callback) > 128 {
-		return false
+func (lp *LongPollingConnection) Peer() protocol.PeerInfo {
+	return lp.peer
+}
+
+func (lp *LongPollingConnection) flush() {
+	lp.Closed.Store(true)
+	lp.flushOnce.Do(func() { close(lp.flushed) })
+}
+
+func (lp *LongPollingConnection) responses() []protocol.Message {
+	lp.mutex.Lock()
+	defer lp.mutex.Unlock()
+	return lp.pending
+}
+
+func containsConnect(msgs []protocol.Message) bool {
+	for _, msg := range msgs {
+		if msg.Channel().MetaType() == protocol.MetaConnectChannel {
+			return true
+		}
 	}
-	return validJSONPCallback.MatchString(callback)
+	return false
 }
 
-func MakeLongPoll(msgs interface{}, server Server, w http.ResponseWriter) {
-	conn := NewLongPollingConnection()
-	done := make(chan bool, 1)
-	go func() {
-		server.HandleRequest(msgs, conn)
-		done <- true
-	}()
+// pollingConnection is a request scoped transport built on long-polling
+type pollingConnection interface {
+	protocol.Connection
+	longPolling() *LongPollingConnection
+}
+
+func (lp *LongPollingConnection) longPolling() *LongPollingConnection {
+	return lp
+}
+
+// poll hands msgs to the server and waits until the response to the request
+// is complete, or the client goes away
+func poll(msgs interface{}, server Server, pc pollingConnection, r *http.Request) ([]protocol.Message, bool) {
+	conn := pc.longPolling()
+	conn.handle(msgs, server, pc)
+
+	timer := time.NewTimer(MaxPollDuration)
+	defer timer.Stop()
 
 	select {
-	case responseMsgs := <-conn.responseChan:
-		bs, err := json.Marshal(responseMsgs)
-		if err != nil {
-			server.Logger().Warnf("While encoding response msgs: %s", err)
-			return
-		}
+	case <-conn.flushed:
+	case <-timer.C:
+		server.Logger().Warnf("Poll held for %s without a connect reply", MaxPollDuration)
+		conn.Close()
+	case <-r.Context().Done():
+		conn.Close()
+		server.Logger().Debugf("Client went away during poll")
+		return nil, false
+	}
+	return conn.responses(), true
+}
 
-		connJsonp := conn.jsonp.Load()
-		if connJsonp != "" {
-			if !isValidJSONPCallback(connJsonp) {
-				server.Logger().Warnf("Invalid JSONP callback name: %s", connJsonp)
-				http.Error(w, "Invalid JSONP callback", http.StatusBadRequest)
-				return
-			}
-			jsonp := fmt.Sprintf("/**/%s(%s)", connJsonp, string(bs))
-			bs = []byte(jsonp)
-			w.Header().Add("Content-Type", "text/javascript")
-		} else {
-			w.Header().Add("Content-Type", "application/json")
-		}
-		if _, err := w.Write(bs); err != nil {
-			server.Logger().Warnf("While writing HTTP response: %s", err)
-		}
-	case <-done:
-		server.Logger().Debugf("No response")
+func MakeLongPoll(msgs interface{}, server Server, w http.ResponseWriter, r *http.Request) {
+	MakeLongPollWithOptions(msgs, server, w, r, PollOptions{})
+}
+
+func MakeLongPollWithOptions(msgs interface{}, server Server, w http.ResponseWriter, r *http.Request, options PollOptions) {
+	conn := NewLongPollingConnection()
+	conn.peer = PeerFromRequest(r)
+	responseMsgs, ok := poll(msgs, server, conn, r)
+	if !ok {
+		return
+	}
+	responseMsgs = options.adviseMultipleClients(responseMsgs)
+
+	bs, err := json.Marshal(responseMsgs)
+	if err != nil {
+		server.Logger().Warnf("While encoding response msgs: %s", err)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	setWriteDeadline(w, PollWriteTimeout)
+	if _, err := w.Write(bs); err != nil {
+		server.Logger().Warnf("While writing HTTP response: %s", err)
 	}
 }
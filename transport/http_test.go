@@ -1,8 +1,13 @@
 package transport
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/utils"
 )
 
 func TestIsValidJSONPCallback(t *testing.T) {
@@ -35,3 +40,46 @@ func TestIsValidJSONPCallback(t *testing.T) {
 		})
 	}
 }
+
+type replyingServer struct {
+	reply []protocol.Message
+}
+
+func (rs replyingServer) HandleRequest(_ interface{}, conn protocol.Connection) {
+	conn.Send(rs.reply)
+}
+
+func (rs replyingServer) Logger() utils.Logger {
+	return nopLogger{}
+}
+
+func TestMakeCallbackPoll(t *testing.T) {
+	server := replyingServer{[]protocol.Message{{"channel": "/meta/handshake", "successful": true}}}
+
+	t.Run("valid callback", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		MakeCallbackPoll(map[string]interface{}{}, "__jsonp1__", server, w, httptest.NewRequest("GET", "/", nil))
+
+		expectedHeaders := map[string]string{
+			"Content-Type":           "text/javascript; charset=utf-8",
+			"X-Content-Type-Options": "nosniff",
+		}
+		for k, v := range expectedHeaders {
+			if got := w.Header().Get(k); got != v {
+				t.Errorf("%s = %q, want %q", k, got, v)
+			}
+		}
+		expected := `/**/__jsonp1__([{"channel":"/meta/handshake","successful":true}]);`
+		if got := w.Body.String(); got != expected {
+			t.Errorf("body = %s, want %s", got, expected)
+		}
+	})
+
+	t.Run("invalid callback", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		MakeCallbackPoll(map[string]interface{}{}, "alert(1)", server, w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("status = %d, want %d", w.Code, http.StatusBadRequest)
+		}
+	})
+}
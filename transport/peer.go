@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/dsablic/faye-go/protocol"
+)
+
+// PeerFromRequest describes the client that sent r. Behind a proxy, r's
+// RemoteAddr should be rewritten to the client address before it reaches
+// the transports.
+func PeerFromRequest(r *http.Request) protocol.PeerInfo {
+	return protocol.PeerInfo{
+		RemoteAddr: hostOf(r.RemoteAddr),
+		UserAgent:  r.UserAgent(),
+	}
+}
+
+func hostOf(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -1,9 +1,13 @@
 package transport
 
 import (
+	"bytes"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
 	"github.com/dsablic/faye-go/protocol"
 	"github.com/dsablic/faye-go/utils"
@@ -16,27 +20,238 @@ type Server interface {
 	Logger() utils.Logger
 }
 
+type OverflowPolicy int
+
+const (
+	// Close the connection when its send queue is full, the client
+	// reconnects and resumes from a clean state
+	OverflowClose OverflowPolicy = iota
+	// Drop the message that did not fit and keep the connection open
+	OverflowDrop
+)
+
+// Most queued sends coalesced into a single frame
+const maxCoalesce = 128
+
+type WebsocketOptions struct {
+	// Maximum time a single write may block before the connection is
+	// considered dead, zero disables the deadline
+	WriteTimeout time.Duration
+	// How often the server pings an idle peer, zero disables keepalive
+	PingInterval time.Duration
+	// How long after a ping the peer has to answer before it is dropped
+	PongTimeout time.Duration
+	// Largest incoming message in bytes, zero means no limit
+	MaxMessageSize int64
+	// Number of sends buffered for the connection's writer
+	SendQueueSize int
+	// What happens to a send when the queue is full
+	Overflow OverflowPolicy
+	// Deflate level from -2 (Huffman only) to 9 used when permessage-deflate
+	// is negotiated, zero keeps the default of 1 (best speed)
+	CompressionLevel int
+	// Frames with smaller payloads are sent uncompressed, as compressing
+	// them costs more than it saves
+	CompressionThreshold int
+	// Counts written bytes when set
+	Stats *WebsocketStats
+}
+
+var DefaultWebsocketOptions = WebsocketOptions{
+	WriteTimeout:         10 * time.Second,
+	PingInterval:         30 * time.Second,
+	PongTimeout:          10 * time.Second,
+	MaxMessageSize:       1 << 20,
+	SendQueueSize:        256,
+	Overflow:             OverflowClose,
+	CompressionThreshold: 256,
+}
+
+type outgoing struct {
+	msgs    []protocol.Message
+	encoded *protocol.EncodedMessage
+}
+
+// WebSocketConnection hands every send to a single writer goroutine, so
+// callers never block on the socket and writes from different sources do
+// not contend with each other.
 type WebSocketConnection struct {
-	ws     *websocket.Conn
-	failed *atomic.Bool
-	mutex  sync.RWMutex
+	ws        *websocket.Conn
+	failed    *atomic.Bool
+	outbox    chan outgoing
+	done      chan struct{}
+	closeOnce sync.Once
+	peer      protocol.PeerInfo
+	options   WebsocketOptions
+}
+
+func NewWebSocketConnection(ws *websocket.Conn, options WebsocketOptions) *WebSocketConnection {
+	if options.SendQueueSize <= 0 {
+		options.SendQueueSize = DefaultWebsocketOptions.SendQueueSize
+	}
+	wc := &WebSocketConnection{
+		ws:      ws,
+		failed:  atomic.NewBool(false),
+		outbox:  make(chan outgoing, options.SendQueueSize),
+		done:    make(chan struct{}),
+		peer:    protocol.PeerInfo{RemoteAddr: hostOf(ws.RemoteAddr().String())},
+		options: options,
+	}
+	if options.CompressionLevel != 0 {
+		// Invalid levels are ignored and leave the default in place
+		ws.SetCompressionLevel(options.CompressionLevel)
+	}
+	go wc.writeLoop()
+	return wc
 }
 
 func (wc *WebSocketConnection) Send(msgs []protocol.Message) error {
+	return wc.enqueue(outgoing{msgs: msgs})
+}
+
+func (wc *WebSocketConnection) SendEncoded(em *protocol.EncodedMessage) error {
+	return wc.enqueue(outgoing{encoded: em})
+}
+
+func (wc *WebSocketConnection) enqueue(o outgoing) error {
 	if !wc.IsConnected() {
 		return errors.New("not connected")
 	}
-	wc.mutex.Lock()
-	err := wc.ws.WriteJSON(msgs)
-	wc.mutex.Unlock()
-	if err != nil {
-		wc.failed.Store(true)
+	select {
+	case wc.outbox <- o:
+		return nil
+	default:
+	}
+
+	if wc.options.Overflow == OverflowClose {
+		wc.Close()
+		return errors.New("send queue full, connection closed")
+	}
+	return fmt.Errorf("send queue full: %w", protocol.ErrDropped)
+}
+
+func (wc *WebSocketConnection) writeLoop() {
+	var pings <-chan time.Time
+	if wc.options.PingInterval > 0 {
+		ticker := time.NewTicker(wc.options.PingInterval)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+
+	batch := make([]outgoing, 0, maxCoalesce)
+	for {
+		select {
+		case <-wc.done:
+			return
+		case <-pings:
+			deadline := time.Now().Add(wc.options.PongTimeout)
+			if err := wc.ws.WriteControl(websocket.PingMessage, nil, deadline); err != nil {
+				wc.Close()
+				return
+			}
+		case o := <-wc.outbox:
+			batch = append(batch[:0], o)
+		coalesce:
+			for len(batch) < maxCoalesce {
+				select {
+				case o := <-wc.outbox:
+					batch = append(batch, o)
+				default:
+					break coalesce
+				}
+			}
+			if err := wc.write(batch); err != nil {
+				wc.Close()
+				return
+			}
+		}
+	}
+}
+
+func (wc *WebSocketConnection) write(batch []outgoing) error {
+	if wc.options.WriteTimeout > 0 {
+		wc.ws.SetWriteDeadline(time.Now().Add(wc.options.WriteTimeout))
+	}
+
+	if len(batch) == 1 && batch[0].encoded != nil {
+		js, err := batch[0].encoded.JSON()
+		if err != nil {
+			return err
+		}
+		frame, err := batch[0].encoded.Frame(preparedTextMessage)
+		if err != nil {
+			return err
+		}
+		// The frame payload wraps the message in brackets
+		return wc.writeCounted(len(js)+2, func() error {
+			return wc.ws.WritePreparedMessage(frame.(*websocket.PreparedMessage))
+		})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	first := true
+	appendJSON := func(js []byte) {
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		buf.Write(js)
 	}
-	return err
+	for _, o := range batch {
+		if o.encoded != nil {
+			js, err := o.encoded.JSON()
+			if err != nil {
+				return err
+			}
+			appendJSON(js)
+			continue
+		}
+		for _, msg := range o.msgs {
+			js, err := json.Marshal(msg)
+			if err != nil {
+				return err
+			}
+			appendJSON(js)
+		}
+	}
+	buf.WriteByte(']')
+	return wc.writeCounted(buf.Len(), func() error {
+		return wc.ws.WriteMessage(websocket.TextMessage, buf.Bytes())
+	})
+}
+
+// writeCounted writes a frame of size payload bytes, compressing it only
+// when it reaches the threshold, and records it in the stats
+func (wc *WebSocketConnection) writeCounted(size int, write func() error) error {
+	wc.ws.EnableWriteCompression(size >= wc.options.CompressionThreshold)
+
+	stats := wc.options.Stats
+	if stats == nil {
+		return write()
+	}
+	before, counted := bytesWritten(wc.ws.NetConn())
+	if err := write(); err != nil {
+		return err
+	}
+	stats.PayloadBytes.Add(uint64(size))
+	if counted {
+		after, _ := bytesWritten(wc.ws.NetConn())
+		stats.WireBytes.Add(after - before)
+	}
+	// Counted last, so a reader seeing the frame sees its bytes too
+	stats.Frames.Inc()
+	return nil
+}
+
+func preparedTextMessage(payload []byte) (interface{}, error) {
+	return websocket.NewPreparedMessage(websocket.TextMessage, payload)
 }
 
-func (wc *WebSocketConnection) SendJsonp(msgs []protocol.Message, _ string) error {
-	return errors.New("jsonp is not supported over websockets")
+func (wc *WebSocketConnection) extendReadDeadline() {
+	if wc.options.PingInterval > 0 {
+		wc.ws.SetReadDeadline(time.Now().Add(wc.options.PingInterval + wc.options.PongTimeout))
+	}
 }
 
 func (wc *WebSocketConnection) IsConnected() bool {
@@ -45,6 +260,7 @@ func (wc *WebSocketConnection) IsConnected() bool {
 
 func (wc *WebSocketConnection) Close() {
 	wc.failed.Store(true)
+	wc.closeOnce.Do(func() { close(wc.done) })
 	wc.ws.Close()
 }
 
@@ -52,38 +268,60 @@ func (wc *WebSocketConnection) IsSingleShot() bool {
 	return false
 }
 
+func (wc *WebSocketConnection) Peer() protocol.PeerInfo {
+	return wc.peer
+}
+
 func WebsocketServer(m Server) func(*websocket.Conn) {
+	return WebsocketServerWithOptions(m, DefaultWebsocketOptions)
+}
+
+func WebsocketServerWithOptions(m Server, options WebsocketOptions) func(*websocket.Conn) {
 	return func(ws *websocket.Conn) {
-		var data interface{}
-		wsConn := WebSocketConnection{ws: ws, failed: atomic.NewBool(false)}
-		for {
-			err := ws.ReadJSON(&data)
-			if err != nil {
-				wsConn.failed.Store(true)
-				ws.Close()
-				if err == io.EOF {
-					m.Logger().Debugf("EOF while reading from socket")
-					return
-				}
-				m.Logger().Debugf("While reading from socket: %s", err)
+		ServeWebsocket(m, ws, protocol.PeerInfo{RemoteAddr: hostOf(ws.RemoteAddr().String())}, options)
+	}
+}
+
+// ServeWebsocket reads messages from ws until it fails, peer describes the
+// client as seen in its upgrade request
+func ServeWebsocket(m Server, ws *websocket.Conn, peer protocol.PeerInfo, options WebsocketOptions) {
+	var data interface{}
+	wsConn := NewWebSocketConnection(ws, options)
+	wsConn.peer = peer
+	defer wsConn.Close()
+	if options.MaxMessageSize > 0 {
+		ws.SetReadLimit(options.MaxMessageSize)
+	}
+	if options.PingInterval > 0 {
+		ws.SetPongHandler(func(string) error {
+			wsConn.extendReadDeadline()
+			return nil
+		})
+		wsConn.extendReadDeadline()
+	}
+	for {
+		err := ws.ReadJSON(&data)
+		if err != nil {
+			if err == io.EOF {
+				m.Logger().Debugf("EOF while reading from socket")
 				return
 			}
+			m.Logger().Debugf("While reading from socket: %s", err)
+			return
+		}
 
-			arr, ok := data.([]interface{})
-			if !ok {
-				m.HandleRequest(data, &wsConn)
-				continue
-			}
+		wsConn.extendReadDeadline()
 
-			if len(arr) == 0 {
-				wsConn.mutex.Lock()
-				if ws.WriteJSON([]string{}) != nil {
-					wsConn.Close()
-				}
-				wsConn.mutex.Unlock()
-			} else {
-				m.HandleRequest(data, &wsConn)
-			}
+		arr, ok := data.([]interface{})
+		if !ok {
+			m.HandleRequest(data, wsConn)
+			continue
+		}
+
+		if len(arr) == 0 {
+			wsConn.Send([]protocol.Message{})
+		} else {
+			m.HandleRequest(data, wsConn)
 		}
 	}
 }
@@ -0,0 +1,314 @@
+package transport
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dsablic/faye-go/protocol"
+	"github.com/dsablic/faye-go/utils"
+	"github.com/gorilla/websocket"
+	"go.uber.org/atomic"
+)
+
+// newWebsocketPairs returns n server side connections whose clients discard
+// everything they receive, or forward it to received when it is not nil.
+func newWebsocketPairs(tb testing.TB, n int, received chan<- []byte) []*WebSocketConnection {
+	tb.Helper()
+	upgrader := websocket.Upgrader{}
+	conns := make(chan *websocket.Conn, n)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			tb.Errorf("upgrade: %v", err)
+			return
+		}
+		conns <- ws
+	}))
+	tb.Cleanup(srv.Close)
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	pairs := make([]*WebSocketConnection, 0, n)
+	for i := 0; i < n; i++ {
+		client, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			tb.Fatalf("dial: %v", err)
+		}
+		tb.Cleanup(func() { client.Close() })
+		go func() {
+			for {
+				_, r, err := client.NextReader()
+				if err != nil {
+					return
+				}
+				if received == nil {
+					io.Copy(io.Discard, r)
+					continue
+				}
+				bs, _ := io.ReadAll(r)
+				received <- bs
+			}
+		}()
+		ws := <-conns
+		tb.Cleanup(func() { ws.Close() })
+		pairs = append(pairs, NewWebSocketConnection(ws, DefaultWebsocketOptions))
+	}
+	return pairs
+}
+
+func benchmarkMessage() protocol.Message {
+	data := map[string]interface{}{}
+	for _, k := range []string{"alpha", "beta", "gamma", "delta", "epsilon", "zeta"} {
+		data[k] = strings.Repeat(k, 20)
+	}
+	return protocol.Message{"channel": "/chat/room1", "data": data, "id": "42"}
+}
+
+func TestSendEncoded(t *testing.T) {
+	received := make(chan []byte, 1)
+	conn := newWebsocketPairs(t, 1, received)[0]
+	msg := protocol.Message{"channel": "/foo", "data": "bar"}
+
+	if err := conn.SendEncoded(protocol.NewEncodedMessage(msg)); err != nil {
+		t.Fatalf("SendEncoded() error = %v", err)
+	}
+
+	var got []protocol.Message
+	if err := json.Unmarshal(<-received, &got); err != nil {
+		t.Fatalf("invalid frame: %v", err)
+	}
+	if len(got) != 1 || got[0]["channel"] != "/foo" || got[0]["data"] != "bar" {
+		t.Errorf("received %v, want [%v]", got, msg)
+	}
+}
+
+func TestSendCoalescesQueuedMessages(t *testing.T) {
+	received := make(chan []byte, 100)
+	conn := newWebsocketPairs(t, 1, received)[0]
+
+	const total = 100
+	for i := 0; i < total; i++ {
+		msg := protocol.Message{"channel": "/foo", "data": float64(i)}
+		var err error
+		if i%2 == 0 {
+			err = conn.Send([]protocol.Message{msg})
+		} else {
+			err = conn.SendEncoded(protocol.NewEncodedMessage(msg))
+		}
+		if err != nil {
+			t.Fatalf("send %d: %v", i, err)
+		}
+	}
+
+	next := 0
+	for next < total {
+		select {
+		case frame := <-received:
+			var got []protocol.Message
+			if err := json.Unmarshal(frame, &got); err != nil {
+				t.Fatalf("invalid frame %s: %v", frame, err)
+			}
+			for _, msg := range got {
+				if msg["data"] != float64(next) {
+					t.Fatalf("message %d has data %v, want %d", next, msg["data"], next)
+				}
+				next++
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d messages", next, total)
+		}
+	}
+}
+
+func TestSendOverflow(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    OverflowPolicy
+		connected bool
+	}{
+		{"close", OverflowClose, false},
+		{"drop", OverflowDrop, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ws := newWebsocketPairs(t, 1, nil)[0].ws
+			// No writer goroutine drains the outbox, so the second send overflows
+			conn := &WebSocketConnection{
+				ws:      ws,
+				failed:  atomic.NewBool(false),
+				outbox:  make(chan outgoing, 1),
+				done:    make(chan struct{}),
+				options: WebsocketOptions{Overflow: tt.policy},
+			}
+
+			if err := conn.Send([]protocol.Message{{}}); err != nil {
+				t.Fatalf("first Send() error = %v", err)
+			}
+			if err := conn.Send([]protocol.Message{{}}); err == nil {
+				t.Errorf("Send() on a full queue succeeded")
+			}
+			if got := conn.IsConnected(); got != tt.connected {
+				t.Errorf("IsConnected() = %v, want %v", got, tt.connected)
+			}
+		})
+	}
+}
+
+const fanOut = 100
+
+func BenchmarkFanOutWriteJSON(b *testing.B) {
+	conns := newWebsocketPairs(b, fanOut, nil)
+	msg := benchmarkMessage()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, conn := range conns {
+			if err := conn.write([]outgoing{{msgs: []protocol.Message{msg}}}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkFanOutEncodedOnce(b *testing.B) {
+	conns := newWebsocketPairs(b, fanOut, nil)
+	msg := benchmarkMessage()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		em := protocol.NewEncodedMessage(msg)
+		for _, conn := range conns {
+			if err := conn.write([]outgoing{{encoded: em}}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Warnf(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+func (nopLogger) Fatalf(string, ...interface{}) {}
+func (nopLogger) Panicf(string, ...interface{}) {}
+
+// capturingServer remembers the connection of the last request it handled
+type capturingServer struct {
+	mutex sync.Mutex
+	conn  protocol.Connection
+	seen  chan struct{}
+}
+
+func newCapturingServer() *capturingServer {
+	return &capturingServer{seen: make(chan struct{}, 16)}
+}
+
+func (cs *capturingServer) HandleRequest(_ interface{}, conn protocol.Connection) {
+	cs.mutex.Lock()
+	cs.conn = conn
+	cs.mutex.Unlock()
+	cs.seen <- struct{}{}
+}
+
+func (cs *capturingServer) Logger() utils.Logger {
+	return nopLogger{}
+}
+
+func (cs *capturingServer) connection() protocol.Connection {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.conn
+}
+
+func dialWebsocketServer(t *testing.T, server Server, options WebsocketOptions) *websocket.Conn {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		WebsocketServerWithOptions(server, options)(ws)
+	}))
+	t.Cleanup(srv.Close)
+
+	client, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+func waitForDisconnect(conn protocol.Connection, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if !conn.IsConnected() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestKeepalive(t *testing.T) {
+	options := WebsocketOptions{
+		WriteTimeout: time.Second,
+		PingInterval: 20 * time.Millisecond,
+		PongTimeout:  20 * time.Millisecond,
+	}
+
+	t.Run("responsive peer stays connected", func(t *testing.T) {
+		server := newCapturingServer()
+		client := dialWebsocketServer(t, server, options)
+		go func() {
+			for {
+				if _, _, err := client.NextReader(); err != nil {
+					return
+				}
+			}
+		}()
+		client.WriteJSON(map[string]interface{}{"channel": "/meta/connect"})
+		<-server.seen
+
+		if waitForDisconnect(server.connection(), 200*time.Millisecond) {
+			t.Errorf("connection answering pings was dropped")
+		}
+	})
+
+	t.Run("silent peer is dropped", func(t *testing.T) {
+		server := newCapturingServer()
+		client := dialWebsocketServer(t, server, options)
+		client.WriteJSON(map[string]interface{}{"channel": "/meta/connect"})
+		<-server.seen
+
+		if !waitForDisconnect(server.connection(), time.Second) {
+			t.Errorf("connection not answering pings is still connected")
+		}
+	})
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server := newCapturingServer()
+	options := DefaultWebsocketOptions
+	options.MaxMessageSize = 64
+	client := dialWebsocketServer(t, server, options)
+
+	client.WriteJSON(map[string]interface{}{"channel": "/meta/connect"})
+	<-server.seen
+	client.WriteJSON(map[string]interface{}{"channel": "/foo", "data": strings.Repeat("x", 128)})
+
+	if !waitForDisconnect(server.connection(), time.Second) {
+		t.Errorf("connection sending oversized message is still connected")
+	}
+}